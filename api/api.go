@@ -1,22 +1,36 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/Sirupsen/logrus"
 	"github.com/bacaldwell/lustre-graph-driver/driver"
+	"github.com/docker/docker/pkg/archive"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	defaultContentTypeV1          = "appplication/vnd.docker.plugins.v1+json"
 	defaultImplementationManifest = `{"Implements": ["GraphDriver"]}`
-	pluginSpecDir                 = "/etc/docker/plugins"
 	pluginSockDir                 = "/run/docker/plugins"
 
+	// SpecNone writes no spec file for unix sockets, docker finds them in
+	// the plugin socket dir. TCP listeners always get a spec file.
+	SpecNone = ""
+	// SpecText writes a .spec file that contains the address of the plugin
+	SpecText = "spec"
+	// SpecJSON writes a .json spec file, which can carry a TLS configuration
+	SpecJSON = "json"
+
 	activatePath = "/Plugin.Activate"
 	createPath   = "/GraphDriver.Create"
 	removePath   = "/GraphDriver.Remove"
@@ -25,64 +39,128 @@ const (
 	existsPath   = "/GraphDriver.Exists"
 	statusPath   = "/GraphDriver.Status"
 	cleanupPath  = "/GraphDriver.Cleanup"
+	metadataPath = "/GraphDriver.GetMetadata"
+	healthPath   = "/health"
 )
 
 // Request is the structure that docker's requests are deserialized to.
 type graphDriverRequest struct {
-	ID         string `json:",omitempty"`
-	Parent     string `json:",omitempty"`
-	MountLabel string `json:",omitempty"`
+	ID         string            `json:",omitempty"`
+	Parent     string            `json:",omitempty"`
+	MountLabel string            `json:",omitempty"`
+	StorageOpt map[string]string `json:",omitempty"`
 }
 
 // Response is the strucutre that the plugin's responses are serialized to.
 type graphDriverResponse struct {
-	Err    error       `json:",omitempty"`
-	Dir    string      `json:",omitempty"`
-	Exists bool        `json:",omitempty"`
-	Status [][2]string `json:",omitempty"`
+	Err          string            `json:",omitempty"`
+	Dir          string            `json:",omitempty"`
+	Exists       bool              `json:",omitempty"`
+	Status       [][2]string       `json:",omitempty"`
+	Metadata     map[string]string `json:",omitempty"`
+	Changes      []archive.Change  `json:",omitempty"`
+	Size         int64             `json:",omitempty"`
+	Capabilities *capabilities     `json:",omitempty"`
 }
 
 type graphEventsCounter struct {
-	activations int
-	creations   int
-	removals    int
-	gets        int
-	puts        int
-	stats       int
-	cleanups    int
-	exists      int
+	activations int64
+	creations   int64
+	removals    int64
+	gets        int64
+	puts        int64
+	stats       int64
+	cleanups    int64
+	exists      int64
+	metadata    int64
+	inits       int64
+	diffs       int64
+	changes     int64
+	applyDiffs  int64
+	diffSizes   int64
+}
+
+// pluginSpecDir is where docker looks for spec files, tests redirect it
+var pluginSpecDir = "/etc/docker/plugins"
+
+// SpecTLSConfig is the TLS configuration docker uses to connect to the
+// plugin, as written to a .json spec file.
+type SpecTLSConfig struct {
+	InsecureSkipVerify bool
+	CAFile             string `json:",omitempty"`
+	CertFile           string `json:",omitempty"`
+	KeyFile            string `json:",omitempty"`
+}
+
+// pluginSpec is the content of a .json spec file.
+type pluginSpec struct {
+	Name      string
+	Addr      string
+	TLSConfig *SpecTLSConfig `json:",omitempty"`
 }
 
 // Handler forwards requests and responses between the docker daemon and the plugin.
 type Handler struct {
-	driver graphdriver.Driver
-	ec     *graphEventsCounter
-	mux    *http.ServeMux
+	driver     graphdriver.Driver // Set by Init when running as a managed plugin
+	initFunc   graphdriver.InitFunc
+	ec         *graphEventsCounter
+	mux        *http.ServeMux
+	specFormat string
+	specTLS    *SpecTLSConfig
+	authorizer Authorizer
+	initLock   sync.Mutex // Serializes Init, which doesn't hold the handler lock
+
+	sync.Mutex   // Protects driver, server, shutdown and cleanupFiles
+	server       *http.Server
+	shutdown     bool
+	cleanupFiles []string
 }
 
 // NewHandler initializes the request handler with a driver implementation.
 func NewHandler(driver graphdriver.Driver) *Handler {
-	h := &Handler{driver, &graphEventsCounter{}, http.NewServeMux()}
+	h := &Handler{driver: driver, ec: &graphEventsCounter{}, mux: http.NewServeMux()}
 	h.initMux()
 	return h
 }
 
+// SetAuthorizer restricts the endpoints TLS clients may call.
+func (h *Handler) SetAuthorizer(a Authorizer) {
+	h.authorizer = a
+}
+
+// SetSpec selects the kind of spec file written for docker to discover the
+// plugin, SpecNone, SpecText or SpecJSON. tlsConfig is only written to
+// SpecJSON files and may be nil.
+func (h *Handler) SetSpec(format string, tlsConfig *SpecTLSConfig) error {
+	switch format {
+	case SpecNone, SpecText, SpecJSON:
+	default:
+		return fmt.Errorf("unknown spec format %q", format)
+	}
+	h.specFormat = format
+	h.specTLS = tlsConfig
+	return nil
+}
+
 func (h *Handler) initMux() {
 	h.mux.HandleFunc(activatePath, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&h.ec.activations, 1)
+
 		w.Header().Set("Content-Type", defaultContentTypeV1)
 		fmt.Fprintln(w, defaultImplementationManifest)
 	})
 
 	h.mux.HandleFunc(createPath, func(w http.ResponseWriter, r *http.Request) {
-		h.ec.creations++
+		atomic.AddInt64(&h.ec.creations, 1)
 
 		var req graphDriverRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, err.Error(), 500)
 		}
 
-		if err := h.driver.Create(req.ID, req.Parent); err != nil {
-			http.Error(w, err.Error(), 500)
+		if err := h.create(r.Context(), req); err != nil {
+			driverError(w, err)
+			return
 		}
 
 		w.Header().Set("Content-Type", "appplication/vnd.docker.plugins.v1+json")
@@ -90,15 +168,16 @@ func (h *Handler) initMux() {
 	})
 
 	h.mux.HandleFunc("/GraphDriver.Remove", func(w http.ResponseWriter, r *http.Request) {
-		h.ec.removals++
+		atomic.AddInt64(&h.ec.removals, 1)
 
 		var req graphDriverRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, err.Error(), 500)
 		}
 
-		if err := h.driver.Remove(req.ID); err != nil {
-			http.Error(w, err.Error(), 500)
+		if err := h.remove(r.Context(), req.ID); err != nil {
+			driverError(w, err)
+			return
 		}
 
 		w.Header().Set("Content-Type", "appplication/vnd.docker.plugins.v1+json")
@@ -106,16 +185,17 @@ func (h *Handler) initMux() {
 	})
 
 	h.mux.HandleFunc("/GraphDriver.Get", func(w http.ResponseWriter, r *http.Request) {
-		h.ec.gets++
+		atomic.AddInt64(&h.ec.gets, 1)
 
 		var req graphDriverRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, err.Error(), 500)
 		}
 
-		dir, err := h.driver.Get(req.ID, req.MountLabel)
+		dir, err := h.get(r.Context(), req.ID, req.MountLabel)
 		if err != nil {
-			http.Error(w, err.Error(), 500)
+			driverError(w, err)
+			return
 		}
 
 		w.Header().Set("Content-Type", "appplication/vnd.docker.plugins.v1+json")
@@ -123,15 +203,16 @@ func (h *Handler) initMux() {
 	})
 
 	h.mux.HandleFunc("/GraphDriver.Put", func(w http.ResponseWriter, r *http.Request) {
-		h.ec.puts++
+		atomic.AddInt64(&h.ec.puts, 1)
 
 		var req graphDriverRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, err.Error(), 500)
 		}
 
-		if err := h.driver.Put(req.ID); err != nil {
-			http.Error(w, err.Error(), 500)
+		if err := h.put(r.Context(), req.ID); err != nil {
+			driverError(w, err)
+			return
 		}
 
 		w.Header().Set("Content-Type", "appplication/vnd.docker.plugins.v1+json")
@@ -139,7 +220,7 @@ func (h *Handler) initMux() {
 	})
 
 	h.mux.HandleFunc("/GraphDriver.Exists", func(w http.ResponseWriter, r *http.Request) {
-		h.ec.exists++
+		atomic.AddInt64(&h.ec.exists, 1)
 
 		var req graphDriverRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -147,18 +228,18 @@ func (h *Handler) initMux() {
 		}
 
 		w.Header().Set("Content-Type", "appplication/vnd.docker.plugins.v1+json")
-		fmt.Fprintln(w, fmt.Sprintf(`{"Exists": %b}`, h.driver.Exists(req.ID)))
+		json.NewEncoder(w).Encode(graphDriverResponse{Exists: h.driver.Exists(req.ID)})
 	})
 
 	h.mux.HandleFunc("/GraphDriver.Status", func(w http.ResponseWriter, r *http.Request) {
-		h.ec.stats++
+		atomic.AddInt64(&h.ec.stats, 1)
 
 		w.Header().Set("Content-Type", "appplication/vnd.docker.plugins.v1+json")
-		fmt.Fprintln(w, `{}`)
+		json.NewEncoder(w).Encode(graphDriverResponse{Status: h.driver.Status()})
 	})
 
 	h.mux.HandleFunc("/GraphDriver.Cleanup", func(w http.ResponseWriter, r *http.Request) {
-		h.ec.cleanups++
+		atomic.AddInt64(&h.ec.cleanups, 1)
 
 		if err := h.driver.Cleanup(); err != nil {
 			http.Error(w, err.Error(), 500)
@@ -167,33 +248,111 @@ func (h *Handler) initMux() {
 		w.Header().Set("Content-Type", "appplication/vnd.docker.plugins.v1+json")
 		fmt.Fprintln(w, `{}`)
 	})
+
+	h.mux.HandleFunc(metadataPath, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&h.ec.metadata, 1)
+
+		var req graphDriverRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		metadata, err := h.driver.GetMetadata(req.ID)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		w.Header().Set("Content-Type", defaultContentTypeV1)
+		json.NewEncoder(w).Encode(graphDriverResponse{Metadata: metadata})
+	})
+
+	h.mux.HandleFunc(healthPath, h.serveHealth)
+
+	h.initV2Mux()
+}
+
+// serveHealth reports the health of the driver as JSON, with status 503
+// while it is unhealthy. Drivers that don't check their health are healthy
+// once initialized.
+func (h *Handler) serveHealth(w http.ResponseWriter, r *http.Request) {
+	health := graphdriver.Health{Healthy: true}
+	switch driver := h.Driver().(type) {
+	case nil:
+		health = graphdriver.Health{Problems: []string{"graph driver is not initialized"}}
+	case graphdriver.HealthChecker:
+		health = driver.Health()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !health.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(health)
+}
+
+// ServeMetrics serves the request counters of the handler on addr, in the
+// Prometheus text format under /metrics, and the health of the driver under
+// /health.
+func (h *Handler) ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(healthPath, h.serveHealth)
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, c := range []struct {
+			name  string
+			value int64
+		}{
+			{"activate", atomic.LoadInt64(&h.ec.activations)},
+			{"create", atomic.LoadInt64(&h.ec.creations)},
+			{"remove", atomic.LoadInt64(&h.ec.removals)},
+			{"get", atomic.LoadInt64(&h.ec.gets)},
+			{"put", atomic.LoadInt64(&h.ec.puts)},
+			{"exists", atomic.LoadInt64(&h.ec.exists)},
+			{"status", atomic.LoadInt64(&h.ec.stats)},
+			{"cleanup", atomic.LoadInt64(&h.ec.cleanups)},
+			{"metadata", atomic.LoadInt64(&h.ec.metadata)},
+			{"init", atomic.LoadInt64(&h.ec.inits)},
+			{"diff", atomic.LoadInt64(&h.ec.diffs)},
+			{"changes", atomic.LoadInt64(&h.ec.changes)},
+			{"applydiff", atomic.LoadInt64(&h.ec.applyDiffs)},
+			{"diffsize", atomic.LoadInt64(&h.ec.diffSizes)},
+		} {
+			fmt.Fprintf(w, "lustre_graphdriver_requests_total{endpoint=%q} %d\n", c.name, c.value)
+		}
+	})
+	return http.ListenAndServe(addr, mux)
 }
 
 // ServeTCP makes the handler to listen for request in a given TCP address.
 // It also writes the spec file on the right directory for docker to read.
-func (h *Handler) ServeTCP(pluginName, addr string) error {
-	return h.listenAndServe("tcp", addr, pluginName)
+// The listener uses TLS when tlsConfig is not nil.
+func (h *Handler) ServeTCP(pluginName, addr string, tlsConfig *TLSConfig) error {
+	return h.listenAndServe("tcp", addr, pluginName, tlsConfig)
 }
 
 // ServeUnix makes the handler to listen for requests in a unix socket.
 // It also creates the socket file on the right directory for docker to read.
+// addr is either the name of a socket in that directory or the absolute path
+// of a socket anywhere, in which case a spec file should be written too.
 func (h *Handler) ServeUnix(systemGroup, addr string) error {
-	return h.listenAndServe("unix", addr, systemGroup)
+	return h.listenAndServe("unix", addr, systemGroup, nil)
 }
 
-func (h *Handler) listenAndServe(proto, addr, group string) error {
-	server := http.Server{
-		Addr:    addr,
-		Handler: h.mux,
-	}
-
+func (h *Handler) listenAndServe(proto, addr, group string, tlsConfig *TLSConfig) error {
 	var l net.Listener
 	var err error
+	var spec string
 	switch proto {
 	case "tcp":
-		l, err = newTCPSocket(addr, nil)
+		l, err = newTCPSocket(addr, tlsConfig)
 		if err == nil {
-			err = writeSpec(group, l.Addr().String())
+			format := h.specFormat
+			if format == SpecNone {
+				format = SpecText
+			}
+			spec, err = writeSpec(group, "tcp://"+l.Addr().String(), format, h.specTLS)
 		}
 	case "unix":
 		var s string
@@ -201,22 +360,115 @@ func (h *Handler) listenAndServe(proto, addr, group string) error {
 		if err == nil {
 			l, err = newUnixSocket(s, group)
 		}
+		if err == nil {
+			h.addCleanupFile(s)
+			if h.specFormat != SpecNone {
+				name := strings.TrimSuffix(filepath.Base(s), ".sock")
+				spec, err = writeSpec(name, "unix://"+s, h.specFormat, nil)
+			}
+		}
+	}
+	if spec != "" {
+		h.addCleanupFile(spec)
 	}
 	if err != nil {
+		if l != nil {
+			l.Close()
+		}
+		h.removeCleanupFiles()
 		return err
 	}
 
-	return server.Serve(l)
+	return h.serve(l)
 }
 
-func writeSpec(name, addr string) error {
-	if err := os.MkdirAll(pluginSpecDir, 0755); err != nil {
+// serve serves requests on l until the listener fails or Shutdown is called.
+func (h *Handler) serve(l net.Listener) error {
+	server := &http.Server{
+		Handler: h.authorize(h.requireDriver(h.mux)),
+	}
+	h.Lock()
+	if h.shutdown {
+		h.Unlock()
+		l.Close()
+		h.removeCleanupFiles()
+		return nil
+	}
+	h.server = server
+	h.Unlock()
+
+	if err := sdNotify("READY=1"); err != nil {
+		logrus.Warnf("Notifying systemd failed: %v", err)
+	}
+	if interval := watchdogInterval(); interval > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go watchdog(interval, stop)
+	}
+
+	if err := server.Serve(l); err != http.ErrServerClosed {
 		return err
 	}
+	return nil
+}
+
+// Shutdown stops accepting new requests and waits up to timeout for the
+// requests in flight to finish. The socket and spec files created by the
+// handler are removed either way. It returns context.DeadlineExceeded when
+// some requests didn't finish in time.
+func (h *Handler) Shutdown(timeout time.Duration) error {
+	h.Lock()
+	server := h.server
+	h.shutdown = true
+	h.Unlock()
+	sdNotify("STOPPING=1")
+
+	var err error
+	if server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err = server.Shutdown(ctx); err != nil {
+			server.Close()
+		}
+	}
+	h.removeCleanupFiles()
+	return err
+}
+
+func (h *Handler) addCleanupFile(file string) {
+	h.Lock()
+	h.cleanupFiles = append(h.cleanupFiles, file)
+	h.Unlock()
+}
+
+func (h *Handler) removeCleanupFiles() {
+	h.Lock()
+	defer h.Unlock()
+	for _, file := range h.cleanupFiles {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			logrus.Warnf("Failed to remove %s: %v", file, err)
+		}
+	}
+	h.cleanupFiles = nil
+}
+
+// writeSpec writes a spec file for the plugin name and returns its path.
+func writeSpec(name, url, format string, tlsConfig *SpecTLSConfig) (string, error) {
+	if err := os.MkdirAll(pluginSpecDir, 0755); err != nil {
+		return "", err
+	}
+
+	if format == SpecJSON {
+		b, err := json.Marshal(pluginSpec{Name: name, Addr: url, TLSConfig: tlsConfig})
+		if err != nil {
+			return "", err
+		}
+		spec := filepath.Join(pluginSpecDir, name+".json")
+		return spec, ioutil.WriteFile(spec, b, 0644)
+	}
 
 	spec := filepath.Join(pluginSpecDir, name+".spec")
-	url := "tcp://" + addr
-	return ioutil.WriteFile(spec, []byte(url), 0644)
+	return spec, ioutil.WriteFile(spec, []byte(url), 0644)
 }
 
 func fullSocketAddr(addr string) (string, error) {
@@ -0,0 +1,328 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetSpec(t *testing.T) {
+	h := NewHandler(nil)
+	for _, format := range []string{SpecNone, SpecText, SpecJSON} {
+		if err := h.SetSpec(format, nil); err != nil {
+			t.Errorf("SetSpec(%q): %v", format, err)
+		}
+	}
+	if err := h.SetSpec("yaml", nil); err == nil {
+		t.Error("Expected an unknown spec format to be rejected")
+	}
+}
+
+func TestWriteSpec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spec-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { pluginSpecDir = d }(pluginSpecDir)
+	pluginSpecDir = filepath.Join(dir, "plugins")
+
+	spec, err := writeSpec("lustre", "unix:///run/lustre.sock", SpecText, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec != filepath.Join(pluginSpecDir, "lustre.spec") {
+		t.Fatalf("Unexpected spec file %s", spec)
+	}
+	b, err := ioutil.ReadFile(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "unix:///run/lustre.sock" {
+		t.Fatalf("Unexpected .spec content %q", b)
+	}
+
+	tlsConfig := &SpecTLSConfig{CAFile: "/etc/ca.pem", CertFile: "/etc/cert.pem", KeyFile: "/etc/key.pem"}
+	spec, err = writeSpec("lustre", "tcp://127.0.0.1:7000", SpecJSON, tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec != filepath.Join(pluginSpecDir, "lustre.json") {
+		t.Fatalf("Unexpected spec file %s", spec)
+	}
+	b, err = ioutil.ReadFile(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got pluginSpec
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	expected := pluginSpec{Name: "lustre", Addr: "tcp://127.0.0.1:7000", TLSConfig: tlsConfig}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, got)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spec-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { pluginSpecDir = d }(pluginSpecDir)
+	pluginSpecDir = dir
+
+	for _, c := range []struct {
+		name     string
+		timeout  time.Duration
+		expected error
+	}{
+		{"finished", time.Minute, nil},
+		{"cut off", 50 * time.Millisecond, context.DeadlineExceeded},
+	} {
+		h := NewHandler(nil)
+		entered := make(chan struct{})
+		release := make(chan struct{})
+		h.mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+			close(entered)
+			<-release
+		})
+		errs := make(chan error, 1)
+		go func() {
+			errs <- h.ServeTCP("lustre", "127.0.0.1:0", nil)
+		}()
+		addr := waitForSpec(t, filepath.Join(dir, "lustre.spec"))
+
+		go http.Get("http://" + addr + "/slow")
+		<-entered
+		shutdown := make(chan error, 1)
+		go func() {
+			shutdown <- h.Shutdown(c.timeout)
+		}()
+		if c.expected == nil {
+			// Shutdown waits for the request in flight
+			select {
+			case err := <-shutdown:
+				t.Fatalf("%s: Shutdown returned %v with a request in flight", c.name, err)
+			case <-time.After(50 * time.Millisecond):
+			}
+			close(release)
+			err = <-shutdown
+		} else {
+			err = <-shutdown
+			close(release)
+		}
+		if err != c.expected {
+			t.Fatalf("%s: expected Shutdown to return %v, got %v", c.name, c.expected, err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatalf("%s: expected serving to stop cleanly, got %v", c.name, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "lustre.spec")); !os.IsNotExist(err) {
+			t.Fatalf("%s: expected the spec file to be removed, got %v", c.name, err)
+		}
+	}
+}
+
+func TestShutdownBeforeServe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spec-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { pluginSpecDir = d }(pluginSpecDir)
+	pluginSpecDir = dir
+
+	h := NewHandler(nil)
+	if err := h.Shutdown(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.ServeTCP("lustre", "127.0.0.1:0", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "lustre.spec")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the spec file to be removed, got %v", err)
+	}
+}
+
+// waitForSpec waits for the plugin to write its .spec file and returns the
+// TCP address in it.
+func waitForSpec(t *testing.T, spec string) string {
+	for i := 0; i < 100; i++ {
+		if b, err := ioutil.ReadFile(spec); err == nil && len(b) > 0 {
+			return strings.TrimPrefix(string(b), "tcp://")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("%s wasn't written", spec)
+	return ""
+}
+
+func TestSubjectAuthorizer(t *testing.T) {
+	a := SubjectAuthorizer{
+		"docker-node1": {"*"},
+		"monitor":      {"/GraphDriver.Status", "/GraphDriver.Exists"},
+		"nobody":       {},
+	}
+	for _, c := range []struct {
+		subject, endpoint string
+		allowed           bool
+	}{
+		{"docker-node1", "/GraphDriver.Remove", true},
+		{"monitor", "/GraphDriver.Status", true},
+		{"monitor", "/GraphDriver.Exists", true},
+		{"monitor", "/GraphDriver.Remove", false},
+		{"nobody", "/GraphDriver.Status", false},
+		{"unknown", "/GraphDriver.Status", false},
+		{"", "/GraphDriver.Status", false},
+	} {
+		if allowed := a.Authorize(c.subject, c.endpoint); allowed != c.allowed {
+			t.Errorf("Authorize(%q, %q) = %t, expected %t", c.subject, c.endpoint, allowed, c.allowed)
+		}
+	}
+}
+
+func TestLoadSubjectAuthorizer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authz-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct {
+		content string
+		valid   bool
+	}{
+		{`{"monitor": ["/GraphDriver.Status"]}`, true},
+		{`{}`, true},
+		{`{"monitor": "/GraphDriver.Status"}`, false},
+		{`not json`, false},
+	} {
+		file := filepath.Join(dir, "authz.json")
+		if err := ioutil.WriteFile(file, []byte(c.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadSubjectAuthorizer(file); (err == nil) != c.valid {
+			t.Errorf("Loading %s: expected valid %t, got %v", c.content, c.valid, err)
+		}
+	}
+	if _, err := LoadSubjectAuthorizer(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("Expected loading a missing file to fail")
+	}
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key := writeCertificate(t, dir)
+
+	for _, c := range []struct {
+		name       string
+		config     TLSConfig
+		clientAuth tls.ClientAuthType
+		valid      bool
+	}{
+		{"no CA", TLSConfig{Certificate: cert, Key: key}, tls.NoClientCert, true},
+		{"no CA, verify", TLSConfig{Certificate: cert, Key: key, Verify: true}, tls.NoClientCert, true},
+		{"CA", TLSConfig{CA: cert, Certificate: cert, Key: key}, tls.RequireAndVerifyClientCert, true},
+		{"CA, verify", TLSConfig{CA: cert, Certificate: cert, Key: key, Verify: true}, tls.RequireAndVerifyClientCert, true},
+		{"missing key", TLSConfig{Certificate: cert, Key: filepath.Join(dir, "missing.pem")}, 0, false},
+		{"missing CA", TLSConfig{CA: filepath.Join(dir, "missing.pem"), Certificate: cert, Key: key}, 0, false},
+	} {
+		config, err := serverTLSConfig(&c.config)
+		if !c.valid {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if config.ClientAuth != c.clientAuth {
+			t.Errorf("%s: expected client auth %v, got %v", c.name, c.clientAuth, config.ClientAuth)
+		}
+		if (config.ClientCAs != nil) != (c.config.CA != "") {
+			t.Errorf("%s: expected client CAs only with a CA", c.name)
+		}
+	}
+}
+
+func TestNewTCPSocketTLSError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	config := &TLSConfig{Certificate: "/nonexistent/cert.pem", Key: "/nonexistent/key.pem"}
+	if _, err := newTCPSocket(addr, config); err == nil {
+		t.Fatal("Expected an error without certificates")
+	}
+	// The listener must have been closed again
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Expected %s to be free again: %v", addr, err)
+	}
+	l.Close()
+}
+
+// writeCertificate writes a self-signed CA certificate and its key to dir.
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "lustre-graph-driver"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := filepath.Join(dir, "cert.pem")
+	key := filepath.Join(dir, "key.pem")
+	for file, block := range map[string]*pem.Block{
+		cert: {Type: "CERTIFICATE", Bytes: der},
+		key:  {Type: "EC PRIVATE KEY", Bytes: keyDer},
+	} {
+		if err := ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cert, key
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// Authorizer decides which endpoints a TLS client may call. Clients are
+// identified by the common name of their certificate subject.
+type Authorizer interface {
+	Authorize(subject, endpoint string) bool
+}
+
+// SubjectAuthorizer maps certificate subject common names to the endpoints
+// they may call, e.g.
+//
+//	{"docker-node1": ["*"], "monitor": ["/GraphDriver.Status", "/GraphDriver.Exists"]}
+//
+// "*" allows every endpoint. Subjects that aren't listed may call nothing.
+type SubjectAuthorizer map[string][]string
+
+// LoadSubjectAuthorizer reads a SubjectAuthorizer from a JSON file.
+func LoadSubjectAuthorizer(file string) (SubjectAuthorizer, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := SubjectAuthorizer{}
+	if err := json.NewDecoder(f).Decode(&a); err != nil {
+		return nil, fmt.Errorf("Unable to parse authorization file %s: %v", file, err)
+	}
+	return a, nil
+}
+
+// Authorize implements Authorizer.
+func (a SubjectAuthorizer) Authorize(subject, endpoint string) bool {
+	for _, allowed := range a[subject] {
+		if allowed == "*" || allowed == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize wraps next so that TLS clients can only call the endpoints the
+// authorizer allows for their certificate. Activation is always allowed so
+// docker can discover what the plugin implements. Requests that didn't come
+// over TLS, i.e. over the unix socket, are not checked.
+func (h *Handler) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.authorizer == nil || r.TLS == nil || r.URL.Path == activatePath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "client certificate required", http.StatusForbidden)
+			return
+		}
+		subject := r.TLS.PeerCertificates[0].Subject.CommonName
+		if !h.authorizer.Authorize(subject, r.URL.Path) {
+			http.Error(w, fmt.Sprintf("%s is not allowed to call %s", subject, r.URL.Path), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
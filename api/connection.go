@@ -54,14 +54,27 @@ func newTCPSocket(addr string, config *TLSConfig) (net.Listener, error) {
 		return nil, err
 	}
 	if config != nil {
-		if l, err = setupTLS(l, config); err != nil {
+		tl, err := setupTLS(l, config)
+		if err != nil {
+			l.Close()
 			return nil, err
 		}
+		l = tl
 	}
 	return l, nil
 }
 
 func setupTLS(l net.Listener, config *TLSConfig) (net.Listener, error) {
+	tlsConfig, err := serverTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, tlsConfig), nil
+}
+
+// serverTLSConfig loads the certificates of config. With a CA, only
+// clients with a certificate signed by it can connect.
+func serverTLSConfig(config *TLSConfig) (*tls.Config, error) {
 	tlsCert, err := tls.LoadX509KeyPair(config.Certificate, config.Key)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -73,8 +86,8 @@ func setupTLS(l net.Listener, config *TLSConfig) (net.Listener, error) {
 	tlsConfig := &tls.Config{
 		NextProtos:   []string{"http/1.1"},
 		Certificates: []tls.Certificate{tlsCert},
-		// Avoid fallback on insecure SSL protocols
-		MinVersion: tls.VersionTLS10,
+		// Avoid fallback on insecure SSL and TLS protocols
+		MinVersion: tls.VersionTLS12,
 	}
 	if config.CA != "" {
 		certPool := x509.NewCertPool()
@@ -86,7 +99,7 @@ func setupTLS(l net.Listener, config *TLSConfig) (net.Listener, error) {
 		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
 		tlsConfig.ClientCAs = certPool
 	}
-	return tls.NewListener(l, tlsConfig), nil
+	return tlsConfig, nil
 }
 
 func setSocketGroup(path, group string) error {
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/bacaldwell/lustre-graph-driver/driver"
+	"github.com/docker/docker/pkg/archive"
+)
+
+// The driver calls below pass the context of the request to drivers that
+// implement graphdriver.ContextDriver, so a request docker gave up on stops
+// waiting on the filesystem and releases what it holds.
+
+func (h *Handler) create(ctx context.Context, req graphDriverRequest) error {
+	if cd, ok := h.driver.(graphdriver.ContextDriver); ok {
+		return cd.CreateContext(ctx, req.ID, req.Parent, req.MountLabel, req.StorageOpt)
+	}
+	return h.driver.Create(req.ID, req.Parent)
+}
+
+func (h *Handler) createReadWrite(ctx context.Context, req graphDriverRequest) error {
+	if cd, ok := h.driver.(graphdriver.ContextDriver); ok {
+		return cd.CreateReadWriteContext(ctx, req.ID, req.Parent, req.MountLabel, req.StorageOpt)
+	}
+	if rw, ok := h.driver.(graphdriver.ReadWriteCreator); ok {
+		return rw.CreateReadWrite(req.ID, req.Parent, req.MountLabel, req.StorageOpt)
+	}
+	return h.driver.Create(req.ID, req.Parent)
+}
+
+func (h *Handler) remove(ctx context.Context, id string) error {
+	if cd, ok := h.driver.(graphdriver.ContextDriver); ok {
+		return cd.RemoveContext(ctx, id)
+	}
+	return h.driver.Remove(id)
+}
+
+func (h *Handler) get(ctx context.Context, id, mountLabel string) (string, error) {
+	if cd, ok := h.driver.(graphdriver.ContextDriver); ok {
+		return cd.GetContext(ctx, id, mountLabel)
+	}
+	return h.driver.Get(id, mountLabel)
+}
+
+func (h *Handler) put(ctx context.Context, id string) error {
+	if cd, ok := h.driver.(graphdriver.ContextDriver); ok {
+		return cd.PutContext(ctx, id)
+	}
+	return h.driver.Put(id)
+}
+
+func (h *Handler) applyDiff(ctx context.Context, diffDriver graphdriver.DiffDriver, id, parent string, diff archive.Reader) (int64, error) {
+	if cd, ok := h.driver.(graphdriver.ContextDriver); ok {
+		return cd.ApplyDiffContext(ctx, id, parent, diff)
+	}
+	return diffDriver.ApplyDiff(id, parent, diff)
+}
+
+func (h *Handler) diffSize(ctx context.Context, diffDriver graphdriver.DiffDriver, id, parent string) (int64, error) {
+	if cd, ok := h.driver.(graphdriver.ContextDriver); ok {
+		return cd.DiffSizeContext(ctx, id, parent)
+	}
+	return diffDriver.DiffSize(id, parent)
+}
+
+// driverError responds with the error of a driver call. Operations that
+// timed out get 504 so they can be told apart from other failures.
+func driverError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if graphdriver.IsTimeout(err) {
+		status = http.StatusGatewayTimeout
+	}
+	http.Error(w, err.Error(), status)
+}
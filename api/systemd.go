@@ -0,0 +1,159 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// The first file descriptor passed by systemd socket activation, see
+// sd_listen_fds(3).
+const listenFdsStart = 3
+
+var errNoActivationSocket = errors.New("no socket passed by systemd")
+
+// SocketActivated reports whether systemd passed listening sockets to the
+// process.
+func SocketActivated() bool {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return false
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	return err == nil && n > 0
+}
+
+// activationListeners returns the listeners passed by systemd. The
+// environment variables are unset so the sockets aren't passed on to child
+// processes.
+func activationListeners() ([]net.Listener, error) {
+	if !SocketActivated() {
+		return nil, errNoActivationSocket
+	}
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := []net.Listener{}
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%d", fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("socket %d passed by systemd: %v", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// ServeActivated makes the handler serve requests on the socket passed by
+// systemd socket activation instead of creating its own. The socket belongs
+// to systemd, so it is left in place on Shutdown. A TCP socket uses TLS when
+// tlsConfig is not nil and gets a spec file named pluginName like with
+// ServeTCP; a unix socket only gets one when a spec format was set.
+func (h *Handler) ServeActivated(pluginName string, tlsConfig *TLSConfig) error {
+	listeners, err := activationListeners()
+	if err != nil {
+		return err
+	}
+	if len(listeners) != 1 {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return fmt.Errorf("expected one socket from systemd, got %d", len(listeners))
+	}
+	l := listeners[0]
+
+	var spec string
+	switch addr := l.Addr().(type) {
+	case *net.TCPAddr:
+		if tlsConfig != nil {
+			if l, err = setupTLS(l, tlsConfig); err != nil {
+				listeners[0].Close()
+				return err
+			}
+		}
+		format := h.specFormat
+		if format == SpecNone {
+			format = SpecText
+		}
+		spec, err = writeSpec(pluginName, "tcp://"+addr.String(), format, h.specTLS)
+	case *net.UnixAddr:
+		if h.specFormat != SpecNone {
+			spec, err = writeSpec(pluginName, "unix://"+addr.Name, h.specFormat, nil)
+		}
+	}
+	if spec != "" {
+		h.addCleanupFile(spec)
+	}
+	if err != nil {
+		l.Close()
+		h.removeCleanupFiles()
+		return err
+	}
+
+	logrus.Infof("listening on %s socket %s passed by systemd", l.Addr().Network(), l.Addr())
+	return h.serve(l)
+}
+
+// sdNotify sends state to the service manager, see sd_notify(3). It does
+// nothing when the process wasn't started by systemd with Type=notify.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if addr[0] == '@' {
+		// Abstract socket
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often the service manager expects a watchdog
+// ping, or 0 if the watchdog isn't enabled for this process.
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// watchdog pings the service manager at half the watchdog interval until
+// stop is closed.
+func watchdog(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				logrus.Warnf("Sending watchdog ping failed: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
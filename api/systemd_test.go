@@ -0,0 +1,115 @@
+package api
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// setenv sets the environment variables given as name, value pairs, an
+// empty value unsets one, and returns a function that restores them.
+func setenv(pairs ...string) func() {
+	var restore []func()
+	for i := 0; i < len(pairs); i += 2 {
+		name, value := pairs[i], pairs[i+1]
+		if old, ok := os.LookupEnv(name); ok {
+			restore = append(restore, func() { os.Setenv(name, old) })
+		} else {
+			restore = append(restore, func() { os.Unsetenv(name) })
+		}
+		if value == "" {
+			os.Unsetenv(name)
+		} else {
+			os.Setenv(name, value)
+		}
+	}
+	return func() {
+		for _, f := range restore {
+			f()
+		}
+	}
+}
+
+func TestSocketActivated(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	for _, c := range []struct {
+		pid, fds  string
+		activated bool
+	}{
+		{pid, "1", true},
+		{pid, "2", true},
+		{pid, "0", false},
+		{pid, "", false},
+		{"1", "1", false},
+		{"", "1", false},
+	} {
+		restore := setenv("LISTEN_PID", c.pid, "LISTEN_FDS", c.fds)
+		if activated := SocketActivated(); activated != c.activated {
+			t.Errorf("LISTEN_PID=%q LISTEN_FDS=%q: expected activated %t", c.pid, c.fds, c.activated)
+		}
+		restore()
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	defer setenv("NOTIFY_SOCKET", "")()
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatalf("Expected no error without a notify socket, got %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "notify-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", addr)
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "READY=1" {
+		t.Fatalf("Expected READY=1, got %q", buf[:n])
+	}
+
+	os.Setenv("NOTIFY_SOCKET", filepath.Join(dir, "missing.sock"))
+	if err := sdNotify("READY=1"); err == nil {
+		t.Fatal("Expected an error for a missing notify socket")
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	for _, c := range []struct {
+		pid, usec string
+		interval  time.Duration
+	}{
+		{pid, "30000000", 30 * time.Second},
+		{"", "500000", 500 * time.Millisecond},
+		{"1", "30000000", 0},
+		{pid, "0", 0},
+		{pid, "", 0},
+		{pid, "soon", 0},
+	} {
+		restore := setenv("WATCHDOG_PID", c.pid, "WATCHDOG_USEC", c.usec)
+		if interval := watchdogInterval(); interval != c.interval {
+			t.Errorf("WATCHDOG_PID=%q WATCHDOG_USEC=%q: expected %s, got %s", c.pid, c.usec, c.interval, interval)
+		}
+		restore()
+	}
+}
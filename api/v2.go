@@ -0,0 +1,223 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/bacaldwell/lustre-graph-driver/driver"
+	"github.com/docker/docker/pkg/idtools"
+)
+
+// Endpoints of the graph driver protocol of managed (v2) plugins
+const (
+	initPath            = "/GraphDriver.Init"
+	capabilitiesPath    = "/GraphDriver.Capabilities"
+	createReadWritePath = "/GraphDriver.CreateReadWrite"
+	diffPath            = "/GraphDriver.Diff"
+	changesPath         = "/GraphDriver.Changes"
+	applyDiffPath       = "/GraphDriver.ApplyDiff"
+	diffSizePath        = "/GraphDriver.DiffSize"
+)
+
+// initRequest is sent by docker to managed plugins before any other request.
+type initRequest struct {
+	Home    string
+	Opts    []string
+	UIDMaps []idtools.IDMap
+	GIDMaps []idtools.IDMap
+}
+
+// capabilities are returned by the Capabilities endpoint.
+type capabilities struct {
+	// ReproducesExactDiffs tells docker whether a layer can be diffed
+	// again to get the same tar archive it was created from.
+	ReproducesExactDiffs bool
+}
+
+// NewManagedHandler initializes a request handler for running as a managed
+// plugin. The driver is created by initFunc when docker calls Init, with the
+// home dir, options and ID maps docker passes.
+func NewManagedHandler(initFunc graphdriver.InitFunc) *Handler {
+	h := &Handler{initFunc: initFunc, ec: &graphEventsCounter{}, mux: http.NewServeMux()}
+	h.initMux()
+	return h
+}
+
+// Driver returns the driver of the handler, nil if a managed plugin hasn't
+// been initialized yet.
+func (h *Handler) Driver() graphdriver.Driver {
+	h.Lock()
+	defer h.Unlock()
+	return h.driver
+}
+
+// requireDriver rejects requests that need a driver before Init created it.
+func (h *Handler) requireDriver(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case activatePath, initPath, capabilitiesPath, healthPath:
+		default:
+			if h.Driver() == nil {
+				http.Error(w, "graph driver is not initialized", 500)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *Handler) initV2Mux() {
+	h.mux.HandleFunc(initPath, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&h.ec.inits, 1)
+
+		var req initRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		// Creating the driver can take long, e.g. to mount the filesystem.
+		// Meanwhile other requests fail as not initialized instead of
+		// waiting for the handler lock.
+		h.initLock.Lock()
+		defer h.initLock.Unlock()
+		// Plugins that weren't started by docker already have a driver
+		if h.Driver() == nil {
+			if h.initFunc == nil {
+				http.Error(w, "no driver to initialize", 500)
+				return
+			}
+			driver, err := h.initFunc(req.Home, req.Opts, req.UIDMaps, req.GIDMaps)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			h.Lock()
+			h.driver = driver
+			h.Unlock()
+		}
+
+		w.Header().Set("Content-Type", defaultContentTypeV1)
+		fmt.Fprintln(w, `{}`)
+	})
+
+	h.mux.HandleFunc(capabilitiesPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", defaultContentTypeV1)
+		json.NewEncoder(w).Encode(graphDriverResponse{Capabilities: &capabilities{}})
+	})
+
+	h.mux.HandleFunc(createReadWritePath, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&h.ec.creations, 1)
+
+		var req graphDriverRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		if err := h.createReadWrite(r.Context(), req); err != nil {
+			driverError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", defaultContentTypeV1)
+		fmt.Fprintln(w, `{}`)
+	})
+
+	h.mux.HandleFunc(diffPath, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&h.ec.diffs, 1)
+
+		var req graphDriverRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		diffDriver, ok := h.driver.(graphdriver.DiffDriver)
+		if !ok {
+			http.Error(w, graphdriver.ErrNotSupported.Error(), 500)
+			return
+		}
+
+		arch, err := diffDriver.Diff(req.ID, req.Parent)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		defer arch.Close()
+
+		w.Header().Set("Content-Type", "application/x-tar")
+		io.Copy(w, arch)
+	})
+
+	h.mux.HandleFunc(changesPath, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&h.ec.changes, 1)
+
+		var req graphDriverRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		changer, ok := h.driver.(graphdriver.Changer)
+		if !ok {
+			http.Error(w, graphdriver.ErrNotSupported.Error(), 500)
+			return
+		}
+
+		changes, err := changer.Changes(req.ID, req.Parent)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		w.Header().Set("Content-Type", defaultContentTypeV1)
+		json.NewEncoder(w).Encode(graphDriverResponse{Changes: changes})
+	})
+
+	// The tar archive is the request body, so the IDs are query parameters
+	h.mux.HandleFunc(applyDiffPath, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&h.ec.applyDiffs, 1)
+
+		diffDriver, ok := h.driver.(graphdriver.DiffDriver)
+		if !ok {
+			http.Error(w, graphdriver.ErrNotSupported.Error(), 500)
+			return
+		}
+
+		q := r.URL.Query()
+		size, err := h.applyDiff(r.Context(), diffDriver, q.Get("id"), q.Get("parent"), r.Body)
+		if err != nil {
+			driverError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", defaultContentTypeV1)
+		json.NewEncoder(w).Encode(graphDriverResponse{Size: size})
+	})
+
+	h.mux.HandleFunc(diffSizePath, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&h.ec.diffSizes, 1)
+
+		var req graphDriverRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		diffDriver, ok := h.driver.(graphdriver.DiffDriver)
+		if !ok {
+			http.Error(w, graphdriver.ErrNotSupported.Error(), 500)
+			return
+		}
+
+		size, err := h.diffSize(r.Context(), diffDriver, req.ID, req.Parent)
+		if err != nil {
+			driverError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", defaultContentTypeV1)
+		json.NewEncoder(w).Encode(graphDriverResponse{Size: size})
+	})
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bacaldwell/lustre-graph-driver/driver"
+	"github.com/docker/docker/pkg/idtools"
+)
+
+// existsDriver is a driver that only has a layer named base.
+type existsDriver struct {
+	graphdriver.Driver
+}
+
+func (existsDriver) Exists(id string) bool {
+	return id == "base"
+}
+
+// post sends a request with body encoded as JSON to the handler h serves
+// with and decodes the response into resp, if it isn't nil.
+func post(t *testing.T, h *Handler, path string, body, resp interface{}) int {
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	h.authorize(h.requireDriver(h.mux)).ServeHTTP(w, httptest.NewRequest("POST", path, bytes.NewReader(b)))
+	if resp != nil && w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+	}
+	return w.Code
+}
+
+func TestManagedInit(t *testing.T) {
+	var inits []initRequest
+	h := NewManagedHandler(func(root string, options []string, uidMaps, gidMaps []idtools.IDMap) (graphdriver.Driver, error) {
+		inits = append(inits, initRequest{root, options, uidMaps, gidMaps})
+		return existsDriver{}, nil
+	})
+
+	if code := post(t, h, existsPath, graphDriverRequest{ID: "base"}, nil); code != http.StatusInternalServerError {
+		t.Fatalf("Expected requests before Init to fail, got %d", code)
+	}
+	var caps graphDriverResponse
+	if code := post(t, h, capabilitiesPath, struct{}{}, &caps); code != http.StatusOK || caps.Capabilities == nil {
+		t.Fatalf("Expected capabilities before Init, got %d %+v", code, caps)
+	}
+
+	req := initRequest{
+		Home:    "/var/lib/docker/plugins/lustre",
+		Opts:    []string{"lustre.gc_rate=10"},
+		UIDMaps: []idtools.IDMap{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		GIDMaps: []idtools.IDMap{{ContainerID: 0, HostID: 100000, Size: 65536}},
+	}
+	for i := 0; i < 2; i++ {
+		if code := post(t, h, initPath, req, nil); code != http.StatusOK {
+			t.Fatalf("Init failed with %d", code)
+		}
+	}
+	// Only the first Init creates the driver
+	if !reflect.DeepEqual(inits, []initRequest{req}) {
+		t.Fatalf("Expected one driver created with %+v, got %+v", req, inits)
+	}
+
+	var resp graphDriverResponse
+	if code := post(t, h, existsPath, graphDriverRequest{ID: "base"}, &resp); code != http.StatusOK || !resp.Exists {
+		t.Fatalf("Expected base to exist after Init, got %d %+v", code, resp)
+	}
+}
+
+func TestManagedInitRunning(t *testing.T) {
+	started := make(chan struct{})
+	proceed := make(chan struct{})
+	inits := 0
+	h := NewManagedHandler(func(root string, options []string, uidMaps, gidMaps []idtools.IDMap) (graphdriver.Driver, error) {
+		inits++
+		close(started)
+		<-proceed
+		return existsDriver{}, nil
+	})
+
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() { codes <- post(t, h, initPath, initRequest{Home: "/var/lib/docker"}, nil) }()
+	}
+	<-started
+	// Requests don't wait for the Init that is running
+	done := make(chan int)
+	go func() { done <- post(t, h, existsPath, graphDriverRequest{ID: "base"}, nil) }()
+	select {
+	case code := <-done:
+		if code != http.StatusInternalServerError {
+			t.Fatalf("Expected requests during Init to fail, got %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected requests during Init not to wait for it")
+	}
+
+	close(proceed)
+	for i := 0; i < 2; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Fatalf("Init failed with %d", code)
+		}
+	}
+	if inits != 1 {
+		t.Fatalf("Expected one driver created, got %d", inits)
+	}
+}
+
+func TestManagedInitError(t *testing.T) {
+	h := NewManagedHandler(func(root string, options []string, uidMaps, gidMaps []idtools.IDMap) (graphdriver.Driver, error) {
+		return nil, errors.New("no Lustre here")
+	})
+	if code := post(t, h, initPath, initRequest{Home: "/var/lib/docker"}, nil); code != http.StatusInternalServerError {
+		t.Fatalf("Expected Init to fail, got %d", code)
+	}
+	if h.Driver() != nil {
+		t.Fatal("Expected no driver after a failed Init")
+	}
+}
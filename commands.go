@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/bacaldwell/lustre-graph-driver/driver"
+	flag "github.com/docker/docker/pkg/mflag"
+	"github.com/docker/docker/pkg/units"
+)
+
+// command is a subcommand of the plugin binary. Every command except serve
+// and plugin works directly on the driver root, without Docker running.
+type command struct {
+	name        string
+	args        string
+	description string
+	run         func(args []string) int
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "", "Serve the graph driver plugin API (default)", runServe},
+		{"status", "", "Show the driver status", runStatus},
+		{"ls", "", "List layers with their parents and sizes", runLs},
+		{"inspect", "ID", "Show the metadata of a layer", runInspect},
+		{"mount", "ID", "Mount a layer and print its path", runMount},
+		{"umount", "ID", "Unmount a layer mounted with mount", runUmount},
+		{"rm", "ID", "Remove a layer", runRm},
+		{"gc", "", "Finish deleting removed layers", runGC},
+		{"fsck", "", "Check the driver root for inconsistencies", runFsck},
+		{"evict", "", "Remove least recently used layers above the capacity target", runEvict},
+		{"export", "ID", "Write the diff of a layer as a tar archive to stdout", runExport},
+		{"import", "ID [PARENT]", "Create a layer from a tar archive read from stdin", runImport},
+		{"plugin", "DIR", "Write the config.json and rootfs of a managed plugin to DIR", runPlugin},
+	}
+}
+
+func lookupCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] [COMMAND] [ARGS...]\n\nCommands:\n", os.Args[0])
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(w, "    %s %s\t%s\n", c.name, c.args, c.description)
+	}
+	w.Flush()
+	fmt.Fprintf(os.Stderr, "\nOptions:\n")
+	flag.PrintDefaults()
+}
+
+// parseCommandFlags parses the flags of a subcommand and checks that the
+// number of remaining arguments is between min and max.
+func parseCommandFlags(cmd *flag.FlagSet, args []string, min, max int) bool {
+	cmd.Parse(args)
+	if cmd.NArg() < min || cmd.NArg() > max {
+		fmt.Fprintf(os.Stderr, "Wrong number of arguments for %s\n", cmd.Name())
+		return false
+	}
+	return true
+}
+
+// withDriver creates an offline driver, runs fn with it and cleans it up
+// again.
+func withDriver(fn func(driver graphdriver.Driver) error) int {
+	driver, err := newDriver(true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Create lustre driver failed: %v\n", err)
+		return 1
+	}
+	defer shutdownDriver(driver)
+
+	if err := fn(driver); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func runStatus(args []string) int {
+	cmd := flag.NewFlagSet("status", flag.ExitOnError)
+	if !parseCommandFlags(cmd, args, 0, 0) {
+		return 1
+	}
+
+	return withDriver(func(driver graphdriver.Driver) error {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, pair := range driver.Status() {
+			fmt.Fprintf(w, "%s:\t%s\n", pair[0], pair[1])
+		}
+		return w.Flush()
+	})
+}
+
+func runLs(args []string) int {
+	cmd := flag.NewFlagSet("ls", flag.ExitOnError)
+	flJSON := cmd.Bool([]string{"-json"}, false, "Print the layers as JSON")
+	if !parseCommandFlags(cmd, args, 0, 0) {
+		return 1
+	}
+
+	return withDriver(func(driver graphdriver.Driver) error {
+		lister, ok := driver.(graphdriver.Lister)
+		if !ok {
+			return fmt.Errorf("Driver %s can't list layers", driver)
+		}
+		layers, err := lister.Layers()
+		if err != nil {
+			return err
+		}
+		if *flJSON {
+			return json.NewEncoder(os.Stdout).Encode(layers)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tPARENT\tSIZE")
+		for _, l := range layers {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", l.ID, l.Parent, units.HumanSize(float64(l.Size)))
+		}
+		return w.Flush()
+	})
+}
+
+func runInspect(args []string) int {
+	cmd := flag.NewFlagSet("inspect", flag.ExitOnError)
+	if !parseCommandFlags(cmd, args, 1, 1) {
+		return 1
+	}
+	id := cmd.Arg(0)
+
+	return withDriver(func(driver graphdriver.Driver) error {
+		if !driver.Exists(id) {
+			return fmt.Errorf("No such layer: %s", id)
+		}
+		metadata, err := driver.GetMetadata(id)
+		if err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(metadata))
+		for k := range metadata {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s:\t%s\n", k, metadata[k])
+		}
+		return w.Flush()
+	})
+}
+
+func runMount(args []string) int {
+	cmd := flag.NewFlagSet("mount", flag.ExitOnError)
+	flLabel := cmd.String([]string{"-mount-label"}, "", "SELinux mount label")
+	if !parseCommandFlags(cmd, args, 1, 1) {
+		return 1
+	}
+	id := cmd.Arg(0)
+
+	return withDriver(func(driver graphdriver.Driver) error {
+		// The mount stays after we exit, umount takes it down again
+		dir, err := driver.Get(id, *flLabel)
+		if err != nil {
+			return err
+		}
+		fmt.Println(dir)
+		return nil
+	})
+}
+
+func runUmount(args []string) int {
+	cmd := flag.NewFlagSet("umount", flag.ExitOnError)
+	if !parseCommandFlags(cmd, args, 1, 1) {
+		return 1
+	}
+	id := cmd.Arg(0)
+
+	return withDriver(func(driver graphdriver.Driver) error {
+		return driver.Put(id)
+	})
+}
+
+func runRm(args []string) int {
+	cmd := flag.NewFlagSet("rm", flag.ExitOnError)
+	flForce := cmd.Bool([]string{"f", "-force"}, false, "Unmount the layer first if it is still mounted")
+	if !parseCommandFlags(cmd, args, 1, 1) {
+		return 1
+	}
+	id := cmd.Arg(0)
+
+	return withDriver(func(driver graphdriver.Driver) error {
+		if !driver.Exists(id) {
+			return fmt.Errorf("No such layer: %s", id)
+		}
+		if !*flForce {
+			return driver.Remove(id)
+		}
+		remover, ok := driver.(graphdriver.ForceRemover)
+		if !ok {
+			return fmt.Errorf("Driver %s can't force remove layers", driver)
+		}
+		return remover.ForceRemove(id)
+	})
+}
+
+func runGC(args []string) int {
+	cmd := flag.NewFlagSet("gc", flag.ExitOnError)
+	if !parseCommandFlags(cmd, args, 0, 0) {
+		return 1
+	}
+
+	return withDriver(func(driver graphdriver.Driver) error {
+		gc, ok := driver.(graphdriver.GarbageCollector)
+		if !ok {
+			return fmt.Errorf("Driver %s has no garbage collector", driver)
+		}
+		return gc.CollectGarbage()
+	})
+}
+
+func runEvict(args []string) int {
+	cmd := flag.NewFlagSet("evict", flag.ExitOnError)
+	flDryRun := cmd.Bool([]string{"n", "-dry-run"}, false, "Only report the layers that would be removed")
+	flJSON := cmd.Bool([]string{"-json"}, false, "Print the layers as JSON")
+	if !parseCommandFlags(cmd, args, 0, 0) {
+		return 1
+	}
+
+	return withDriver(func(driver graphdriver.Driver) error {
+		evictor, ok := driver.(graphdriver.Evictor)
+		if !ok {
+			return fmt.Errorf("Driver %s can't evict layers", driver)
+		}
+		evictions, err := evictor.Evict(*flDryRun)
+		if err != nil {
+			return err
+		}
+		if *flJSON {
+			return json.NewEncoder(os.Stdout).Encode(evictions)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSIZE\tLAST USED")
+		var total int64
+		for _, e := range evictions {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", e.ID, units.HumanSize(float64(e.Size)), e.LastUsed.Format(time.RFC3339))
+			total += e.Size
+		}
+		if *flDryRun {
+			fmt.Fprintf(w, "Would free %s\n", units.HumanSize(float64(total)))
+		}
+		return w.Flush()
+	})
+}
+
+func runExport(args []string) int {
+	cmd := flag.NewFlagSet("export", flag.ExitOnError)
+	flOutput := cmd.String([]string{"o", "-output"}, "", "Write to a file instead of stdout")
+	if !parseCommandFlags(cmd, args, 1, 1) {
+		return 1
+	}
+	id := cmd.Arg(0)
+
+	return withDriver(func(driver graphdriver.Driver) error {
+		diffDriver, ok := driver.(graphdriver.DiffDriver)
+		if !ok {
+			return fmt.Errorf("Driver %s can't export layers", driver)
+		}
+		if !driver.Exists(id) {
+			return fmt.Errorf("No such layer: %s", id)
+		}
+
+		var out io.Writer = os.Stdout
+		if *flOutput != "" {
+			f, err := os.Create(*flOutput)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+
+		arch, err := diffDriver.Diff(id, "")
+		if err != nil {
+			return err
+		}
+		defer arch.Close()
+		_, err = io.Copy(out, arch)
+		return err
+	})
+}
+
+func runImport(args []string) int {
+	cmd := flag.NewFlagSet("import", flag.ExitOnError)
+	flInput := cmd.String([]string{"i", "-input"}, "", "Read from a file instead of stdin")
+	if !parseCommandFlags(cmd, args, 1, 2) {
+		return 1
+	}
+	id, parent := cmd.Arg(0), cmd.Arg(1)
+
+	return withDriver(func(driver graphdriver.Driver) error {
+		diffDriver, ok := driver.(graphdriver.DiffDriver)
+		if !ok {
+			return fmt.Errorf("Driver %s can't import layers", driver)
+		}
+
+		var in io.Reader = os.Stdin
+		if *flInput != "" {
+			f, err := os.Open(*flInput)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+
+		if err := driver.Create(id, parent); err != nil {
+			return err
+		}
+		size, err := diffDriver.ApplyDiff(id, parent, in)
+		if err != nil {
+			driver.Remove(id)
+			return err
+		}
+		fmt.Printf("%s %s\n", id, units.HumanSize(float64(size)))
+		return nil
+	})
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/bacaldwell/lustre-graph-driver/api"
+	"github.com/bacaldwell/lustre-graph-driver/driver"
+	flag "github.com/docker/docker/pkg/mflag"
+)
+
+const defaultConfigFile = "/etc/lustre-graph-driver/config.json"
+
+var errTLSAuthz = errors.New("tls-authz needs TLS with tlsverify")
+
+// Config is the configuration file of the plugin daemon. Every setting can
+// also be given as a flag, and flags on the command line win.
+type Config struct {
+	StorageDriver   string   `json:"storage-driver,omitempty"`
+	Graph           string   `json:"graph,omitempty"`
+	StorageOpts     []string `json:"storage-opts,omitempty"`
+	UsernsRemap     string   `json:"userns-remap,omitempty"`
+	Socket          string   `json:"socket,omitempty"`
+	Group           string   `json:"group,omitempty"`
+	PluginSpec      string   `json:"plugin-spec,omitempty"`
+	TLSCACert       string   `json:"tlscacert,omitempty"`
+	TLSCert         string   `json:"tlscert,omitempty"`
+	TLSKey          string   `json:"tlskey,omitempty"`
+	TLSVerify       bool     `json:"tlsverify,omitempty"`
+	TLSClientCert   string   `json:"tls-client-cert,omitempty"`
+	TLSClientKey    string   `json:"tls-client-key,omitempty"`
+	TLSAuthz        string   `json:"tls-authz,omitempty"`
+	TCP             string   `json:"tcp,omitempty"`
+	Debug           bool     `json:"debug,omitempty"`
+	LogLevel        string   `json:"log-level,omitempty"`
+	MetricsAddress  string   `json:"metrics-addr,omitempty"`
+	ShutdownTimeout string   `json:"shutdown-timeout,omitempty"`
+	Managed         bool     `json:"managed,omitempty"`
+}
+
+// loadConfig reads the configuration file. A missing file is only an error
+// when it was asked for explicitly.
+func loadConfig(file string, explicit bool) (*Config, error) {
+	config := &Config{}
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return config, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	if err := dec.Decode(config); err != nil {
+		return nil, fmt.Errorf("Unable to parse configuration file %s: %v", file, err)
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid configuration file %s: %v", file, err)
+	}
+	return config, nil
+}
+
+func (c *Config) validate() error {
+	if c.LogLevel != "" {
+		if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+			return fmt.Errorf("invalid log-level %q", c.LogLevel)
+		}
+	}
+	if c.Graph != "" && !filepath.IsAbs(c.Graph) {
+		return fmt.Errorf("graph must be an absolute path, got %q", c.Graph)
+	}
+	for _, opt := range c.StorageOpts {
+		if !strings.Contains(opt, "=") {
+			return fmt.Errorf("storage-opts must be key=value, got %q", opt)
+		}
+	}
+	for _, file := range []string{c.TLSCACert, c.TLSCert, c.TLSKey, c.TLSClientCert, c.TLSClientKey, c.TLSAuthz} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			return fmt.Errorf("TLS file %s: %v", file, err)
+		}
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return fmt.Errorf("tlscert and tlskey must be given together")
+	}
+	if (c.TLSClientCert == "") != (c.TLSClientKey == "") {
+		return fmt.Errorf("tls-client-cert and tls-client-key must be given together")
+	}
+	if c.TLSVerify && c.TLSCACert == "" {
+		return fmt.Errorf("tlsverify needs tlscacert")
+	}
+	if c.TLSAuthz != "" && !c.TLSVerify {
+		return fmt.Errorf("tls-authz needs tlsverify")
+	}
+	if c.TCP != "" {
+		if _, _, err := net.SplitHostPort(c.TCP); err != nil {
+			return fmt.Errorf("invalid tcp address %q: %v", c.TCP, err)
+		}
+	}
+	switch c.PluginSpec {
+	case api.SpecNone, api.SpecText, api.SpecJSON:
+	default:
+		return fmt.Errorf("plugin-spec must be %q or %q, got %q", api.SpecText, api.SpecJSON, c.PluginSpec)
+	}
+	if c.ShutdownTimeout != "" {
+		if _, err := time.ParseDuration(c.ShutdownTimeout); err != nil {
+			return fmt.Errorf("invalid shutdown-timeout %q: %v", c.ShutdownTimeout, err)
+		}
+	}
+	if c.MetricsAddress != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsAddress); err != nil {
+			return fmt.Errorf("invalid metrics-addr %q: %v", c.MetricsAddress, err)
+		}
+	}
+	return nil
+}
+
+// isSet reports whether any of the names of a flag was given on the
+// command line.
+func isSet(names ...string) bool {
+	for _, name := range names {
+		if flag.IsSet(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyConfig copies the settings of the configuration file that weren't
+// given as flags into the flag variables.
+func applyConfig(c *Config) {
+	if c.StorageDriver != "" && !isSet("s", "-storage-driver") {
+		graphDriver = c.StorageDriver
+	}
+	if c.Graph != "" && !isSet("g", "-graph") {
+		root = c.Graph
+	}
+	if len(c.StorageOpts) > 0 && !isSet("-storage-opt") {
+		graphOptions = c.StorageOpts
+	}
+	if c.UsernsRemap != "" && !isSet("-userns-remap") {
+		flUsernsRemap = c.UsernsRemap
+	}
+	if c.Socket != "" && !isSet("-socket") {
+		socketAddress = c.Socket
+	}
+	if c.Group != "" && !isSet("G", "-group") {
+		socketGroup = c.Group
+	}
+	if c.PluginSpec != "" && !isSet("-plugin-spec") {
+		specFormat = c.PluginSpec
+	}
+	if c.TCP != "" && !isSet("-tcp") {
+		tcpAddress = c.TCP
+	}
+	if c.TLSCACert != "" && !isSet("-tlscacert") {
+		tlsConfig.CA = c.TLSCACert
+	}
+	if c.TLSCert != "" && !isSet("-tlscert") {
+		tlsConfig.Certificate = c.TLSCert
+	}
+	if c.TLSKey != "" && !isSet("-tlskey") {
+		tlsConfig.Key = c.TLSKey
+	}
+	if c.TLSVerify && !isSet("-tlsverify") {
+		tlsConfig.Verify = true
+	}
+	if c.TLSClientCert != "" && !isSet("-tls-client-cert") {
+		tlsClientCert = c.TLSClientCert
+	}
+	if c.TLSClientKey != "" && !isSet("-tls-client-key") {
+		tlsClientKey = c.TLSClientKey
+	}
+	if c.TLSAuthz != "" && !isSet("-tls-authz") {
+		tlsAuthzFile = c.TLSAuthz
+	}
+	if c.ShutdownTimeout != "" && !isSet("-shutdown-timeout") {
+		// validate has checked it parses
+		shutdownTimeout, _ = time.ParseDuration(c.ShutdownTimeout)
+	}
+	if c.Managed && !isSet("-managed") {
+		managed = true
+	}
+	applyLogConfig(c)
+	if c.MetricsAddress != "" {
+		metricsAddress = c.MetricsAddress
+	}
+}
+
+// applyLogConfig applies the logging settings of the configuration file
+// that weren't given as flags.
+func applyLogConfig(c *Config) {
+	if !isSet("l", "-log-level") {
+		flLogLevel = c.LogLevel
+	}
+	if !isSet("D", "-debug") {
+		flDebug = c.Debug
+	}
+}
+
+// setLogLevel sets the logging level from the flag variables.
+func setLogLevel() error {
+	lvl := logrus.InfoLevel
+	if flLogLevel != "" {
+		var err error
+		if lvl, err = logrus.ParseLevel(flLogLevel); err != nil {
+			return fmt.Errorf("Unable to parse logging level: %s", flLogLevel)
+		}
+	}
+	if flDebug {
+		lvl = logrus.DebugLevel
+	}
+	logrus.SetLevel(lvl)
+	return nil
+}
+
+// reloadOnSighup reloads the configuration file on SIGHUP and applies the
+// settings that can change while running: the log level and the driver
+// options the driver can reconfigure (e.g. GC interval and rate).
+// Everything else needs a restart.
+func reloadOnSighup(getDriver func() graphdriver.Driver) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		logrus.Infof("Reloading configuration from %s", flConfigFile)
+		config, err := loadConfig(flConfigFile, true)
+		if err != nil {
+			logrus.Errorf("Reloading configuration failed: %v", err)
+			continue
+		}
+
+		applyLogConfig(config)
+		if err := setLogLevel(); err != nil {
+			logrus.Error(err)
+		}
+
+		driver := getDriver()
+		if driver == nil || isSet("-storage-opt") || len(config.StorageOpts) == 0 {
+			continue
+		}
+		r, ok := driver.(graphdriver.Reconfigurer)
+		if !ok {
+			logrus.Warnf("Driver %s can't change its options while running", driver)
+			continue
+		}
+		if err := r.Reconfigure(config.StorageOpts); err != nil {
+			logrus.Errorf("Reconfiguring driver failed: %v", err)
+			continue
+		}
+		graphOptions = config.StorageOpts
+	}
+}
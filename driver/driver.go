@@ -1,13 +1,18 @@
 package graphdriver
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"path"
+	"time"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/idtools"
 )
 
-type InitFunc func(root string, options []string) (Driver, error)
+type InitFunc func(root string, options []string, uidMaps, gidMaps []idtools.IDMap) (Driver, error)
 
 // Driver represent the interface a driver must fulfill.
 type Driver interface {
@@ -21,6 +26,141 @@ type Driver interface {
 	Cleanup() error
 }
 
+// DiffDriver is implemented by drivers that can export and import layer
+// contents as tar archives.
+type DiffDriver interface {
+	Diff(id, parent string) (archive.Archive, error)
+	ApplyDiff(id, parent string, diff archive.Reader) (size int64, err error)
+	DiffSize(id, parent string) (size int64, err error)
+}
+
+// ReadWriteCreator is implemented by drivers that create the read-write
+// layer of a container differently from image layers.
+type ReadWriteCreator interface {
+	CreateReadWrite(id, parent, mountLabel string, storageOpt map[string]string) error
+}
+
+// ContextDriver is implemented by drivers whose operations can block on
+// the filesystem. The operations stop waiting when ctx is canceled or its
+// deadline passes, and return a TimeoutError for the deadline.
+type ContextDriver interface {
+	CreateContext(ctx context.Context, id, parent, mountLabel string, storageOpt map[string]string) error
+	CreateReadWriteContext(ctx context.Context, id, parent, mountLabel string, storageOpt map[string]string) error
+	RemoveContext(ctx context.Context, id string) error
+	GetContext(ctx context.Context, id, mountLabel string) (string, error)
+	PutContext(ctx context.Context, id string) error
+	ApplyDiffContext(ctx context.Context, id, parent string, diff archive.Reader) (size int64, err error)
+	DiffSizeContext(ctx context.Context, id, parent string) (size int64, err error)
+}
+
+// TimeoutError is returned when a filesystem operation didn't finish before
+// its deadline. The operation may still be running.
+type TimeoutError struct {
+	Op   string
+	Path string
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s %s timed out, the filesystem may be unreachable", e.Op, e.Path)
+}
+
+// Timeout reports that the error is a timeout, like net.Error.
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// IsTimeout reports whether err is a TimeoutError.
+func IsTimeout(err error) bool {
+	_, ok := err.(*TimeoutError)
+	return ok
+}
+
+// Changer is implemented by drivers that can list the changes of a layer
+// relative to its parent.
+type Changer interface {
+	Changes(id, parent string) ([]archive.Change, error)
+}
+
+// Lister is implemented by drivers that can enumerate their layers.
+type Lister interface {
+	Layers() ([]LayerInfo, error)
+}
+
+// LayerInfo describes a layer returned by a Lister.
+type LayerInfo struct {
+	ID     string
+	Parent string `json:",omitempty"`
+	Size   int64
+}
+
+// GarbageCollector is implemented by drivers that delete removed layers in
+// the background, so a pass can be run on demand.
+type GarbageCollector interface {
+	CollectGarbage() error
+}
+
+// Reconfigurer is implemented by drivers that can apply changed options
+// while running. Options that can't change are left as they are.
+type Reconfigurer interface {
+	Reconfigure(options []string) error
+}
+
+// Shutdowner is implemented by drivers whose background work or mounts
+// outlive the docker daemon. Cleanup only releases what the daemon used,
+// Shutdown stops the rest when the plugin exits.
+type Shutdowner interface {
+	Shutdown() error
+}
+
+// ForceRemover is implemented by drivers that can remove a layer that is
+// still mounted, unmounting it first.
+type ForceRemover interface {
+	ForceRemove(id string) error
+}
+
+// Evictor is implemented by drivers that remove least recently used layers
+// to stay below a capacity target.
+type Evictor interface {
+	Evict(dryRun bool) ([]Eviction, error)
+}
+
+// Eviction is a layer removed, or to be removed, by an Evictor.
+type Eviction struct {
+	ID       string
+	Size     int64
+	LastUsed time.Time
+}
+
+// HealthChecker is implemented by drivers that monitor the health of their
+// backing filesystem.
+type HealthChecker interface {
+	Health() Health
+}
+
+// Health is the state of the backing filesystem reported by a
+// HealthChecker.
+type Health struct {
+	Healthy  bool
+	Checked  time.Time // When the last check finished
+	Since    time.Time // When the current state began
+	Problems []string  `json:",omitempty"`
+}
+
+// Checker is implemented by drivers that can check their root for
+// inconsistencies and repair them.
+type Checker interface {
+	Check(repair bool) ([]Problem, error)
+}
+
+// Problem is an inconsistency found by a Checker.
+type Problem struct {
+	Kind     string
+	ID       string `json:",omitempty"`
+	Path     string `json:",omitempty"`
+	Detail   string `json:",omitempty"`
+	Repaired bool
+}
+
 var (
 	DefaultDriver string
 	// All registred drivers
@@ -28,7 +168,7 @@ var (
 	// Slice of drivers that should be used in an order
 	priority = []string{
 		"vfs",
-		"Lustre",
+		"lustre",
 	}
 
 	ErrNotSupported   = errors.New("driver not supported")
@@ -49,23 +189,23 @@ func Register(name string, initFunc InitFunc) error {
 	return nil
 }
 
-func GetDriver(name, home string, options []string) (Driver, error) {
+func GetDriver(name, home string, options []string, uidMaps, gidMaps []idtools.IDMap) (Driver, error) {
 	if initFunc, exists := drivers[name]; exists {
-		return initFunc(path.Join(home, name), options)
+		return initFunc(path.Join(home, name), options, uidMaps, gidMaps)
 	}
 	return nil, ErrNotSupported
 }
 
-func New(root string, options []string) (driver Driver, err error) {
+func New(root string, options []string, uidMaps, gidMaps []idtools.IDMap) (driver Driver, err error) {
 	for _, name := range []string{os.Getenv("DOCKER_DRIVER"), DefaultDriver} {
 		if name != "" {
-			return GetDriver(name, root, options)
+			return GetDriver(name, root, options, uidMaps, gidMaps)
 		}
 	}
 
 	// Check for priority drivers first
 	for _, name := range priority {
-		driver, err = GetDriver(name, root, options)
+		driver, err = GetDriver(name, root, options, uidMaps, gidMaps)
 		if err != nil {
 			if err == ErrNotSupported || err == ErrPrerequisites || err == ErrIncompatibleFS {
 				continue
@@ -77,7 +217,7 @@ func New(root string, options []string) (driver Driver, err error) {
 
 	// Check all registered drivers if no priority driver is found
 	for _, initFunc := range drivers {
-		if driver, err = initFunc(root, options); err != nil {
+		if driver, err = initFunc(root, options, uidMaps, gidMaps); err != nil {
 			if err == ErrNotSupported || err == ErrPrerequisites || err == ErrIncompatibleFS {
 				continue
 			}
@@ -1,6 +1,8 @@
 package graphtest
 
 import (
+	"archive/tar"
+	"bytes"
 	"io/ioutil"
 	"os"
 	"path"
@@ -8,6 +10,7 @@ import (
 	"testing"
 
 	"github.com/bacaldwell/lustre-graph-driver/driver"
+	"github.com/docker/docker/pkg/idtools"
 )
 
 var (
@@ -21,6 +24,10 @@ type Driver struct {
 }
 
 func newDriver(t *testing.T, name string) *Driver {
+	return newDriverWithMaps(t, name, nil, nil)
+}
+
+func newDriverWithMaps(t *testing.T, name string, uidMaps, gidMaps []idtools.IDMap) *Driver {
 	root, err := ioutil.TempDir("/var/tmp", "docker-graphtest-")
 	if err != nil {
 		t.Fatal(err)
@@ -30,7 +37,7 @@ func newDriver(t *testing.T, name string) *Driver {
 		t.Fatal(err)
 	}
 
-	d, err := graphdriver.GetDriver(name, root, nil)
+	d, err := graphdriver.GetDriver(name, root, nil, uidMaps, gidMaps)
 	if err != nil {
 		if err == graphdriver.ErrNotSupported || err == graphdriver.ErrPrerequisites {
 			t.Skip("Driver %s not supported", name)
@@ -41,9 +48,14 @@ func newDriver(t *testing.T, name string) *Driver {
 }
 
 func cleanup(t *testing.T, d *Driver) {
-	if err := drv.Cleanup(); err != nil {
+	if err := d.Cleanup(); err != nil {
 		t.Fatal(err)
 	}
+	if s, ok := d.Driver.(graphdriver.Shutdowner); ok {
+		if err := s.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+	}
 	os.RemoveAll(d.root)
 }
 
@@ -227,3 +239,79 @@ func DriverTestCreateSnap(t *testing.T, drivername string) {
 		t.Fatal(err)
 	}
 }
+
+// Host ids the remapped tests map container root to
+const (
+	remappedUID = 100000
+	remappedGID = 200000
+)
+
+func newRemappedDriver(t *testing.T, drivername string) *Driver {
+	uidMaps := []idtools.IDMap{{ContainerID: 0, HostID: remappedUID, Size: 65536}}
+	gidMaps := []idtools.IDMap{{ContainerID: 0, HostID: remappedGID, Size: 65536}}
+	return newDriverWithMaps(t, drivername, uidMaps, gidMaps)
+}
+
+// Creates an image with a remapped driver and verifies its directory is
+// owned by the remapped root
+func DriverTestRemappedCreate(t *testing.T, drivername string) {
+	driver := newRemappedDriver(t, drivername)
+	defer cleanup(t, driver)
+
+	if err := driver.Create("remapped", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := driver.Get("remapped", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Put("remapped")
+
+	verifyFile(t, dir, 0755|os.ModeDir, remappedUID, remappedGID)
+}
+
+// Applies a diff with a remapped driver and verifies the extracted files are
+// owned by the host ids the container ids map to
+func DriverTestRemappedApplyDiff(t *testing.T, drivername string) {
+	driver := newRemappedDriver(t, drivername)
+	defer cleanup(t, driver)
+
+	diffDriver, ok := driver.Driver.(graphdriver.DiffDriver)
+	if !ok {
+		t.Skipf("Driver %s can't apply diffs", drivername)
+	}
+
+	if err := driver.Create("remapped", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "a subdir/", Typeflag: tar.TypeDir, Mode: 0705, Uid: 1, Gid: 2}); err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("Some data")
+	if err := tw.WriteHeader(&tar.Header{Name: "a file", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := diffDriver.ApplyDiff("remapped", "", buf); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := driver.Get("remapped", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Put("remapped")
+
+	verifyFile(t, path.Join(dir, "a subdir"), 0705|os.ModeDir, remappedUID+1, remappedGID+2)
+	verifyFile(t, path.Join(dir, "a file"), 0644, remappedUID, remappedGID)
+}
@@ -0,0 +1,247 @@
+// +build linux
+
+package lustre
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	mountpk "github.com/docker/docker/pkg/mount"
+)
+
+const (
+	defaultMountCheckInterval = 30 * time.Second
+	// mountCheckerStopTimeout is how long Shutdown waits for a check that
+	// hangs in mount.lustre
+	mountCheckerStopTimeout = 10 * time.Second
+)
+
+// fsNameRegexp matches Lustre filesystem names, at most 8 characters.
+var fsNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{1,8}$`)
+
+// clientMounter mounts and unmounts the Lustre client. The driver uses
+// mount.lustre, tests bind mount a temp dir.
+type clientMounter interface {
+	Mount(source, target, options string) error
+	Unmount(target string, flags int) error
+	// Matches reports whether the existing mount m is a mount of source.
+	Matches(m *mountpk.Info, source string) bool
+}
+
+// lustreMounter mounts with mount(8), so mount.lustre resolves the NIDs.
+type lustreMounter struct{}
+
+func (lustreMounter) Mount(source, target, options string) error {
+	args := []string{"-t", "lustre"}
+	if options != "" {
+		args = append(args, "-o", options)
+	}
+	out, err := exec.Command("mount", append(args, source, target)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("mounting %s on %s failed: %v: %s", source, target, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (lustreMounter) Unmount(target string, flags int) error {
+	return syscall.Unmount(target, flags)
+}
+
+func (lustreMounter) Matches(m *mountpk.Info, source string) bool {
+	return m.Fstype == "lustre" && m.Source == source
+}
+
+// newClientMounter returns the mounter of the client mount, tests replace it.
+var newClientMounter = func() clientMounter { return lustreMounter{} }
+
+// clientMount is the Lustre client mount the driver root is on, when the
+// driver is given the filesystem to mount.
+type clientMount struct {
+	mounter  clientMounter
+	source   string // <mgs nid>:/<fsname>[/<fileset>]
+	target   string
+	options  string
+	owned    bool // Mounted by the driver, so unmounted on Shutdown
+	interval time.Duration
+	timeout  time.Duration // How long statfs may take before the mount is failing
+	probe    *runningOp    // A statfs given up on, only used by the checker
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newClientMount(target string, opts *lustreOptions) *clientMount {
+	source := opts.mgsNID + ":/" + opts.fsName
+	if opts.fileset != "" {
+		source += "/" + opts.fileset
+	}
+	return &clientMount{
+		mounter:  newClientMounter(),
+		source:   source,
+		target:   filepath.Clean(target),
+		options:  opts.mountOptions,
+		interval: opts.mountCheckInterval,
+		timeout:  opts.healthTimeout,
+	}
+}
+
+// mount mounts the client on the target, or checks that the mount already
+// there is of the same filesystem.
+func (c *clientMount) mount() error {
+	m, err := mountInfo(c.target)
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		if !c.mounter.Matches(m, c.source) {
+			return fmt.Errorf("lustre: %s is already mounted from %s, expected %s", c.target, m.Source, c.source)
+		}
+		logrus.Infof("lustre: using existing mount of %s on %s", c.source, c.target)
+		return nil
+	}
+	if err := os.MkdirAll(c.target, 0700); err != nil {
+		return err
+	}
+	if err := c.mounter.Mount(c.source, c.target, c.options); err != nil {
+		return fmt.Errorf("lustre: %v", err)
+	}
+	c.owned = true
+	logrus.Infof("lustre: mounted %s on %s", c.source, c.target)
+	return nil
+}
+
+// healthy reports whether the client is still mounted and answers statfs
+// within the timeout. While a statfs given up on hasn't returned, no new
+// one is started and the mount is failing.
+func (c *clientMount) healthy() error {
+	m, err := mountInfo(c.target)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return fmt.Errorf("%s is not mounted", c.target)
+	}
+	if c.probe != nil {
+		select {
+		case <-c.probe.done:
+			c.probe = nil
+		default:
+			return fmt.Errorf("statfs of %s still hasn't returned", c.target)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	c.probe, err = startFsOp(ctx, "statfs", c.target, func() error {
+		var buf syscall.Statfs_t
+		return syscall.Statfs(c.target, &buf)
+	})
+	return err
+}
+
+// remount detaches what is left of the client mount and mounts it again.
+// Layers mounted from the old mount keep using it until they are unmounted.
+func (c *clientMount) remount() error {
+	if m, _ := mountInfo(c.target); m != nil {
+		if err := c.mounter.Unmount(c.target, syscall.MNT_DETACH); err != nil {
+			return err
+		}
+	}
+	if err := c.mounter.Mount(c.source, c.target, c.options); err != nil {
+		return err
+	}
+	// A hung statfs was on the old mount
+	c.probe = nil
+	return nil
+}
+
+func (c *clientMount) unmount() error {
+	if !c.owned {
+		return nil
+	}
+	if err := c.mounter.Unmount(c.target, 0); err != nil {
+		return fmt.Errorf("lustre: unmounting %s: %v", c.target, err)
+	}
+	c.owned = false
+	return nil
+}
+
+func (c *clientMount) String() string {
+	if c.owned {
+		return c.source + " (mounted by driver)"
+	}
+	return c.source + " (existing mount)"
+}
+
+// startMountChecker checks the client mount every interval and remounts it
+// when it is gone or failing, until stopMountChecker is called.
+func (d *LustreDriver) startMountChecker() {
+	c := d.client
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.done)
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-time.After(c.interval):
+			}
+			d.checkClientMount()
+		}
+	}()
+}
+
+// stopMountChecker stops the checker, giving up on a check that doesn't
+// return in time because mount.lustre hangs.
+func (d *LustreDriver) stopMountChecker() {
+	close(d.client.stop)
+	select {
+	case <-d.client.done:
+	case <-time.After(mountCheckerStopTimeout):
+		logrus.Warnf("lustre: gave up waiting for the check of the client mount of %s", d.client.source)
+	}
+}
+
+func (d *LustreDriver) checkClientMount() {
+	err := d.client.healthy()
+	if err == nil {
+		return
+	}
+	logrus.Warnf("lustre: client mount of %s failed, remounting: %v", d.client.source, err)
+
+	// Not under the driver lock, mount.lustre blocks for as long as the
+	// MGS doesn't answer. Layers mounted meanwhile fail or end up on the
+	// old mount, like the layers that were mounted before.
+	if err := d.client.remount(); err != nil {
+		logrus.Errorf("lustre: remounting %s failed: %v", d.client.source, err)
+		return
+	}
+	if err := mountpk.MakePrivate(d.root); err != nil {
+		logrus.Errorf("lustre: %v", err)
+	}
+}
+
+// mountInfo returns the topmost mount on target, or nil if nothing is
+// mounted there.
+func mountInfo(target string) (*mountpk.Info, error) {
+	mounts, err := mountpk.GetMounts()
+	if err != nil {
+		return nil, err
+	}
+	var info *mountpk.Info
+	for _, m := range mounts {
+		if m.Mountpoint == target {
+			info = m
+		}
+	}
+	return info, nil
+}
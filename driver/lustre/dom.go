@@ -0,0 +1,112 @@
+// +build linux
+
+package lustre
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// domAlign is the granularity of the DoM component size
+	domAlign = 64 * 1024
+
+	defaultDomSize     = domAlign
+	defaultDomRatio    = 0.8
+	defaultDomMinFiles = 100
+
+	// The sample of a layer is taken from its first files, without
+	// buffering more than domSampleBytes of the tar stream
+	domSampleFiles = 1000
+	domSampleBytes = 32 * 1024 * 1024
+)
+
+// sizeSample is the file size distribution of the start of a layer.
+type sizeSample struct {
+	files int // Regular files
+	small int // Regular files that fit in the DoM component
+}
+
+// sampleDiff reads the tar headers of the first files of diff and counts
+// the files that are at most smallSize bytes. It returns a reader that
+// yields the whole of diff again.
+func sampleDiff(diff io.Reader, smallSize int64) (sizeSample, io.Reader) {
+	var s sizeSample
+	var buf bytes.Buffer
+	tr := tar.NewReader(io.TeeReader(diff, &buf))
+	for i := 0; i < domSampleFiles; i++ {
+		hdr, err := tr.Next()
+		if err != nil {
+			// End of the archive or not a tar, let the untar report it
+			break
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		s.files++
+		if hdr.Size <= smallSize {
+			s.small++
+		}
+		if int64(buf.Len())+hdr.Size > domSampleBytes {
+			break
+		}
+		if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+			break
+		}
+	}
+	return s, io.MultiReader(&buf, diff)
+}
+
+// domLayout returns the lfs setstripe arguments of a composite layout that
+// keeps the first size bytes of every file on the MDT and the rest in pool,
+// if one is given.
+func domLayout(size int64, pool string) []string {
+	layout := []string{"-E", strconv.FormatInt(size, 10), "-L", "mdt", "-E", "-1"}
+	if pool != "" {
+		layout = append(layout, "-p", pool)
+	}
+	return layout
+}
+
+// chooseLayout samples diff and returns the layout for the diff dir of a
+// layer, nil to keep the default, and a reader that yields all of diff.
+func (d *LustreDriver) chooseLayout(diff io.Reader) ([]string, io.Reader) {
+	o := d.options
+	if !o.dom {
+		return nil, diff
+	}
+	s, diff := sampleDiff(diff, o.domSize)
+	logrus.Debugf("lustre: layer sample has %d files, %d of them at most %d bytes", s.files, s.small, o.domSize)
+	if s.files < o.domMinFiles || float64(s.small) < o.domRatio*float64(s.files) {
+		return nil, diff
+	}
+	return domLayout(o.domSize, o.imagePool), diff
+}
+
+// applyLayout sets layout as the default layout of the diff or work dir of
+// id, before anything is written to it, and records it. Layouts only affect
+// performance, so failing to set one isn't fatal.
+func (d *LustreDriver) applyLayout(id, kind string, layout []string) {
+	if layout == nil {
+		return
+	}
+	if err := d.setstripe(d.dir(kind, id), layout); err != nil {
+		logrus.Warnf("lustre: setting layout of %s dir of %s failed: %v", kind, id, err)
+		return
+	}
+	err := d.updateMeta(id, func(m *layerMeta) {
+		if kind == workPath {
+			m.WorkLayout = layout
+		} else {
+			m.Layout = layout
+		}
+	})
+	if err != nil {
+		logrus.Warnf("lustre: recording layout of %s failed: %v", id, err)
+	}
+}
@@ -5,10 +5,14 @@
 overlay2 driver directory structure
 
   .
+  ├── health // Canary file of the health checker
   ├── layers // Metadata of layers
   │   ├── 1
   │   ├── 2
   │   └── 3
+  ├── meta   // Driver state of layers, e.g. their Lustre layout
+  │   ├── 1
+  │   └── 3
   ├── diff   // Content of the layer
   │   ├── 1
   │   ├── 2
@@ -17,10 +21,12 @@ overlay2 driver directory structure
   │   ├── 1
   │   ├── 2
   │   └── 3
-  └── work   // overlayfs work directories used for temporary state
-	  ├── 1
-	  ├── 2
-	  └── 3
+  ├── work   // overlayfs work directories used for temporary state
+  │   ├── 1
+  │   ├── 2
+  │   └── 3
+  └── removing // Tombstones of layers that are being removed
+	  └── 4
 
 */
 
@@ -28,23 +34,26 @@ package lustre
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 	"github.com/Sirupsen/logrus"
+	plugindriver "github.com/bacaldwell/lustre-graph-driver/driver"
 	"github.com/docker/docker/daemon/graphdriver"
 	"github.com/docker/docker/pkg/archive"
 	"github.com/docker/docker/pkg/chrootarchive"
 	"github.com/docker/docker/pkg/directory"
 	"github.com/docker/docker/pkg/idtools"
 	mountpk "github.com/docker/docker/pkg/mount"
-	"github.com/docker/docker/pkg/parsers/kernel"
-	"github.com/opencontainers/runc/libcontainer/label"
+	"github.com/opencontainers/runc/libcontainer/selinux"
 )
 
 const (
@@ -52,15 +61,20 @@ const (
 	diffPath   = "diff"
 	layersPath = "layers"
 	workPath   = "work"
+	emptyPath  = "empty" // Lower dir for layers without parents when using idmapped mounts
 )
 
 var (
-	allPaths    = []string{mntPath, diffPath, layersPath, workPath}
+	allPaths    = []string{mntPath, diffPath, layersPath, workPath, removingPath, metaPath}
 	allDirPaths = []string{mntPath, diffPath, workPath} // All paths that contain directories for the given ID (as opposed to files)
 )
 
 const driverName = "overlay2"
 
+// pluginName is the name the driver is registered with in the plugin's own
+// registry, which the socket server and the commands use
+const pluginName = "lustre"
+
 var backingFs = "<unknown>"
 
 // ActiveMount contains information about the count, path and whether is mounted or not.
@@ -68,6 +82,9 @@ var backingFs = "<unknown>"
 type ActiveMount struct {
 	referenceCount int
 	path           string
+	mountLabel     string
+	mounted        bool       // The overlay is mounted on path
+	pending        *runningOp // A mount or unmount that was given up on, see waitPending
 }
 
 // LustreDriver contains information about the root directory and the list of active mounts that are created using this driver.
@@ -77,35 +94,89 @@ type LustreDriver struct {
 	active     map[string]*ActiveMount
 	uidMaps    []idtools.IDMap
 	gidMaps    []idtools.IDMap
+	options    *lustreOptions
+	features   *overlayFeatures
+	userns     *os.File // User namespace for idmapped mounts, nil when layers are chowned
+	gc         *garbageCollector
+	lfs        lfsRunner
+	hsm        *hsmPolicy                     // nil unless HSM is enabled
+	evict      *evictPolicy                   // nil unless a capacity target is set
+	pcc        *pccPolicy                     // nil unless PCC is enabled
+	client     *clientMount                   // nil unless the driver is given the filesystem to mount
+	health     *healthChecker                 // nil when health checks are disabled
+	metaLock   sync.Mutex                     // Serializes updates of layerMeta
+	children   map[string]map[string]struct{} // Reverse-dependency index, parent id to child ids
+	commits    sync.WaitGroup                 // Commits of immutable layers running in the background
+	stopped    sync.Once                      // Shutdown runs once
+	stopErr    error
 }
 
 func init() {
 	graphdriver.Register(driverName, Init)
+	plugindriver.Register(pluginName, initPlugin)
 }
 
-// Init checks for compatibility and creates an instance of the driver
-func Init(root string, options []string, uidMaps, gidMaps []idtools.IDMap) (graphdriver.Driver, error) {
+// pluginDriver is the driver as the plugin's registry sees it, its Create
+// takes no mount label or storage options.
+type pluginDriver struct {
+	*LustreDriver
+}
 
-	if err := supportsOverlay(); err != nil {
-		return nil, graphdriver.ErrNotSupported
+func (d pluginDriver) Create(id, parent string) error {
+	return d.LustreDriver.Create(id, parent, "", nil)
+}
+
+// initPlugin is Init for the plugin's registry. The registry only skips
+// drivers that fail with its own errors, so docker's are translated.
+func initPlugin(root string, options []string, uidMaps, gidMaps []idtools.IDMap) (plugindriver.Driver, error) {
+	driver, err := Init(root, options, uidMaps, gidMaps)
+	switch err {
+	case nil:
+		return pluginDriver{driver.(*LustreDriver)}, nil
+	case graphdriver.ErrNotSupported:
+		return nil, plugindriver.ErrNotSupported
+	case graphdriver.ErrPrerequisites:
+		return nil, plugindriver.ErrPrerequisites
+	case graphdriver.ErrIncompatibleFS:
+		return nil, plugindriver.ErrIncompatibleFS
 	}
+	return nil, err
+}
 
-	version, err := kernel.GetKernelVersion()
+// Init checks for compatibility and creates an instance of the driver
+func Init(root string, options []string, uidMaps, gidMaps []idtools.IDMap) (_ graphdriver.Driver, retErr error) {
+	opts, err := parseOptions(options)
 	if err != nil {
 		return nil, err
 	}
 
-	// require a version of overlay that supports multiple ro layers
-	if kernel.CompareKernelVersion(*version, kernel.VersionInfo{3, 19, 0, ""}) == -1 {
+	if err := supportsOverlay(); err != nil {
 		return nil, graphdriver.ErrNotSupported
 	}
 
+	// Mount the filesystem first when the driver is given one, the
+	// checks below are of the filesystem the root is on
+	var client *clientMount
+	if opts.mgsNID != "" {
+		client = newClientMount(root, opts)
+		if err := client.mount(); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if retErr != nil {
+				client.unmount()
+			}
+		}()
+	}
+
 	fsMagic, err := graphdriver.GetFSMagic(root)
 	if err != nil {
 		return nil, err
 	}
 	if fsName, ok := graphdriver.FsNames[fsMagic]; ok {
 		backingFs = fsName
+	} else if fsMagic == fsMagicLustre {
+		backingFs = "lustre"
 	}
 
 	// check if they are running over btrfs or aufs
@@ -121,6 +192,28 @@ func Init(root string, options []string, uidMaps, gidMaps []idtools.IDMap) (grap
 		return nil, graphdriver.ErrIncompatibleFS
 	}
 
+	// With idmapped mounts layers are stored with host root ownership and
+	// shifted when mounted, so one copy can be shared between mappings
+	var userns *os.File
+	if opts.idMappedMounts && (uidMaps != nil || gidMaps != nil) {
+		userns, err = probeIDMappedMounts(root, uidMaps, gidMaps)
+		if err != nil {
+			logrus.Warnf("idmapped mounts are not supported, falling back to chowning layers: %v", err)
+		} else {
+			uidMaps, gidMaps = nil, nil
+			defer func() {
+				if retErr != nil {
+					userns.Close()
+				}
+			}()
+		}
+	}
+	if uidMaps != nil || gidMaps != nil {
+		if root, err = remappedRoot(root, uidMaps, gidMaps); err != nil {
+			return nil, err
+		}
+	}
+
 	rootUID, rootGID, err := idtools.GetRootUIDGID(uidMaps, gidMaps)
 	if err != nil {
 		return nil, err
@@ -136,17 +229,90 @@ func Init(root string, options []string, uidMaps, gidMaps []idtools.IDMap) (grap
 			return nil, err
 		}
 	}
+	if userns != nil {
+		if err := idtools.MkdirAllAs(path.Join(root, emptyPath), 0755, rootUID, rootGID); err != nil {
+			return nil, err
+		}
+	}
 
 	if err := mountpk.MakePrivate(root); err != nil {
 		return nil, err
 	}
 
-	return &LustreDriver{
-		root:    root,
-		active:  make(map[string]*ActiveMount),
-		uidMaps: uidMaps,
-		gidMaps: gidMaps,
-	}, nil
+	if err := checkBackingFs(root); err != nil {
+		logrus.Error(err)
+		return nil, err
+	}
+
+	// require a version of overlay that supports multiple ro layers
+	features, err := probeOverlay(root)
+	if err != nil {
+		return nil, err
+	}
+	if !features.multiLower {
+		logrus.Error("'overlay' does not support multiple lower directories on this host.")
+		return nil, graphdriver.ErrNotSupported
+	}
+
+	d := &LustreDriver{
+		root:     root,
+		active:   make(map[string]*ActiveMount),
+		uidMaps:  uidMaps,
+		gidMaps:  gidMaps,
+		options:  opts,
+		features: features,
+		userns:   userns,
+		gc:       newGarbageCollector(root, opts.gcInterval, opts.gcRate),
+		lfs:      execLfs{},
+		client:   client,
+	}
+	if opts.hsm {
+		d.hsm = &hsmPolicy{
+			backend:        &lfsHSM{lfs: d.lfs, archiveID: opts.hsmArchiveID},
+			age:            opts.hsmAge,
+			interval:       opts.hsmInterval,
+			restoreTimeout: opts.hsmRestoreTimeout,
+			archiving:      make(map[string]bool),
+			releasing:      make(map[string]bool),
+		}
+	}
+	if opts.pcc {
+		d.pcc = &pccPolicy{threshold: opts.pccThreshold, archiveID: opts.pccArchiveID, attaching: make(map[string]*pccAttaching)}
+	}
+	if opts.capacity != nil {
+		d.evict = &evictPolicy{target: opts.capacity, interval: opts.evictInterval}
+	}
+	if err := d.loadChildren(); err != nil {
+		return nil, err
+	}
+
+	// The commands only work on the layers, the plugin does the rest
+	if opts.offline {
+		return d, nil
+	}
+	d.gc.Start()
+	if d.hsm != nil {
+		d.startArchiver()
+	}
+	if d.evict != nil {
+		d.startEvictor()
+	}
+	if client != nil && client.owned {
+		d.startMountChecker()
+	}
+	if opts.healthInterval > 0 {
+		d.health = &healthChecker{
+			interval: opts.healthInterval,
+			timeout:  opts.healthTimeout,
+			lustre:   fsMagic == fsMagicLustre,
+		}
+		// Know the health before the first request, a failure is reported
+		// but doesn't stop the driver from starting
+		d.checkHealth()
+		d.startHealthChecker()
+	}
+
+	return d, nil
 }
 
 func supportsOverlay() error {
@@ -184,17 +350,132 @@ func (d *LustreDriver) GetMetadata(id string) (map[string]string, error) {
 	metadata["workPath"] = d.dir(workPath, id)
 	ids, _ := d.getParentIds(id)
 	metadata["layers"] = strings.Join(ids, ",")
+	meta, err := d.loadMeta(id)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Layout != nil {
+		metadata["layout"] = strings.Join(meta.Layout, " ")
+	}
+	if meta.WorkLayout != nil {
+		metadata["workLayout"] = strings.Join(meta.WorkLayout, " ")
+	}
+	if !meta.LastUsed.IsZero() {
+		metadata["lastUsed"] = meta.LastUsed.Format(time.RFC3339)
+	}
+	if d.pcc != nil {
+		metadata["pccAttached"] = fmt.Sprintf("%t", meta.PCCAttached)
+	}
+	if meta.Digest != "" {
+		metadata["digest"] = meta.Digest
+		metadata["immutable"] = fmt.Sprintf("%t", meta.Immutable)
+	}
+	if d.hsm != nil {
+		metadata["hsmState"] = meta.HSMState
+		if meta.HSMState == hsmOnline {
+			metadata["hsmState"] = "online"
+		}
+	}
+	// Protect the d.active from concurrent access
+	d.Lock()
+	defer d.Unlock()
 	active, mounted := d.active[id]
 	if mounted {
 		metadata["referenceCount"] = fmt.Sprintf("%d", active.referenceCount)
+		if active.mountLabel != "" {
+			metadata["mountLabel"] = active.mountLabel
+		}
 	}
 
 	return metadata, nil
 }
 
-// Cleanup any state created by overlay which should be cleaned when daemon
-// is being shutdown.
+// Cleanup unmounts the layers that are still mounted. Docker calls it
+// whenever the daemon shuts down while the plugin keeps running, so the
+// driver stays usable and later Gets mount the layers again. Background
+// work and the client mount are only stopped by Shutdown.
 func (d *LustreDriver) Cleanup() error {
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+	d.Lock()
+	defer d.Unlock()
+
+	// waitPending releases the lock, so the map can change meanwhile
+	ids := make([]string, 0, len(d.active))
+	for id := range d.active {
+		ids = append(ids, id)
+	}
+	var firstErr error
+	for _, id := range ids {
+		err := d.waitPending(ctx, id)
+		if m := d.active[id]; err == nil && m != nil {
+			if m.mounted {
+				var r *runningOp
+				r, err = startFsOp(ctx, "unmount", d.dir(mntPath, id), func() error { return d.unmount(id) })
+				if r != nil {
+					m.pending = r
+				}
+			}
+			if err == nil {
+				delete(d.active, id)
+			}
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Shutdown stops the background work of the driver, unmounts its layers
+// and the client mount it owns. The plugin calls it when it exits. Only the
+// first call does anything, later ones return its error.
+func (d *LustreDriver) Shutdown() error {
+	d.stopped.Do(func() {
+		d.stopErr = d.doShutdown()
+	})
+	return d.stopErr
+}
+
+func (d *LustreDriver) doShutdown() error {
+	if !d.options.offline {
+		d.gc.Stop()
+		if d.health != nil {
+			d.stopHealthChecker()
+		}
+		if d.hsm != nil {
+			d.stopArchiver()
+		}
+		if d.evict != nil {
+			d.stopEvictor()
+		}
+	}
+	if d.pcc != nil {
+		d.pcc.wg.Wait()
+	}
+	d.commits.Wait()
+	// Offline the layers and the client mount are left alone, layers
+	// mounted by the mount command and the plugin use them
+	if !d.options.offline {
+		if err := d.Cleanup(); err != nil {
+			return err
+		}
+	}
+	if d.userns != nil {
+		if err := d.userns.Close(); err != nil {
+			return err
+		}
+	}
+	if d.client != nil && d.client.owned && !d.options.offline {
+		d.stopMountChecker()
+		// A remapped root is a private bind mount on the client mount
+		if filepath.Clean(d.root) != d.client.target {
+			if err := mountpk.Unmount(d.root); err != nil {
+				return err
+			}
+		}
+		return d.client.unmount()
+	}
 	return nil
 }
 
@@ -224,22 +505,114 @@ func (d *LustreDriver) getParentIds(id string) ([]string, error) {
 // CreateReadWrite creates a layer that is writable for use as a container
 // file system.
 func (d *LustreDriver) CreateReadWrite(id, parent, mountLabel string, storageOpt map[string]string) error {
-	return d.Create(id, parent, mountLabel, storageOpt)
+	return d.CreateReadWriteContext(context.Background(), id, parent, mountLabel, storageOpt)
+}
+
+// CreateReadWriteContext is CreateReadWrite, giving up when ctx is done.
+func (d *LustreDriver) CreateReadWriteContext(ctx context.Context, id, parent, mountLabel string, storageOpt map[string]string) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+	if err := d.checkHealthy(); err != nil {
+		return err
+	}
+	p, err := d.placementFor(true, storageOpt)
+	if err != nil {
+		return err
+	}
+	if err := d.create(ctx, id, parent, p); err != nil {
+		return err
+	}
+	return d.updateMeta(id, func(m *layerMeta) { m.ReadWrite = true })
 }
 
 // Create creates 4 dirs for each id: mnt, layers, work and diff
 // mnt and work are not used until Get is called, but we create them here anyway to
 // avoid having to create them multiple times
-func (d *LustreDriver) Create(id, parent string, mountLabel string, storageOpt map[string]string) (retErr error) {
+func (d *LustreDriver) Create(id, parent string, mountLabel string, storageOpt map[string]string) error {
+	return d.CreateContext(context.Background(), id, parent, mountLabel, storageOpt)
+}
+
+// CreateContext is Create, giving up when ctx is done.
+func (d *LustreDriver) CreateContext(ctx context.Context, id, parent, mountLabel string, storageOpt map[string]string) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+	if err := d.checkHealthy(); err != nil {
+		return err
+	}
+	p, err := d.placementFor(false, storageOpt)
+	if err != nil {
+		return err
+	}
+	return d.create(ctx, id, parent, p)
+}
 
-	if len(storageOpt) != 0 {
-		return fmt.Errorf("--storage-opt is not supported for overlay")
+func (d *LustreDriver) create(ctx context.Context, id, parent string, p placement) error {
+	// Record the child before the filesystem work, so the parent can't be
+	// removed while the child is created on it
+	d.Lock()
+	if d.Exists(id) {
+		d.Unlock()
+		return fmt.Errorf("layer %s already exists", id)
+	}
+	if parent != "" {
+		if !d.Exists(parent) {
+			d.Unlock()
+			return fmt.Errorf("parent layer %s does not exist", parent)
+		}
+		d.addChild(parent, id)
 	}
+	d.Unlock()
 
-	if err := d.createDirsFor(id); err != nil {
+	r, err := startFsOp(ctx, "create", d.dir(diffPath, id), func() error {
+		if err := d.createDirsFor(id); err != nil {
+			return err
+		}
+		d.applyPlacement(id, p)
+		if err := d.touchLayers([]string{id}); err != nil {
+			return err
+		}
+		return d.writeLayers(id, parent)
+	})
+	if err != nil {
+		// A create that was given up on may still finish, so it keeps the
+		// parent until the driver is restarted
+		if r == nil {
+			d.rollbackCreate(id, parent)
+		}
 		return err
 	}
-	// Write the layers metadata (the stack of parents)
+
+	d.Lock()
+	defer d.Unlock()
+	if parent != "" && d.options.immutableLayers {
+		d.startCommit(parent)
+	}
+	d.active[id] = &ActiveMount{}
+	return nil
+}
+
+// rollbackCreate removes what a failed create of id left behind, and then
+// releases its parent.
+func (d *LustreDriver) rollbackCreate(id, parent string) {
+	for _, p := range []string{layersPath, metaPath} {
+		if err := os.Remove(d.dir(p, id)); err != nil && !os.IsNotExist(err) {
+			logrus.Warnf("Failed to roll back the create of %s: %v", id, err)
+		}
+	}
+	for _, p := range allDirPaths {
+		if err := os.RemoveAll(d.dir(p, id)); err != nil {
+			logrus.Warnf("Failed to roll back the create of %s: %v", id, err)
+		}
+	}
+	if parent != "" {
+		d.Lock()
+		d.removeChild(parent, id)
+		d.Unlock()
+	}
+}
+
+// writeLayers writes the layers metadata of id, the stack of parents.
+func (d *LustreDriver) writeLayers(id, parent string) error {
 	f, err := os.Create(d.dir(layersPath, id))
 	if err != nil {
 		return err
@@ -261,7 +634,6 @@ func (d *LustreDriver) Create(id, parent string, mountLabel string, storageOpt m
 			}
 		}
 	}
-	d.active[id] = &ActiveMount{}
 	return nil
 }
 
@@ -279,45 +651,155 @@ func (d *LustreDriver) createDirsFor(id string) error {
 	return nil
 }
 
-// Remove will unmount and remove the given id.
-// XXX: can this be called even though there are active Get requests? If so, we need to properly Put it first. (to remove intermediate mounts)
+// Remove will unmount and remove the given id. Layers that are still
+// mounted or that other layers are built on are refused with an
+// ErrLayerInUse, unless the lustre.force_remove option is set.
 func (d *LustreDriver) Remove(id string) error {
+	return d.RemoveContext(context.Background(), id)
+}
+
+// RemoveContext is Remove, giving up when ctx is done.
+func (d *LustreDriver) RemoveContext(ctx context.Context, id string) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+	return d.remove(ctx, id, d.options.forceRemove)
+}
+
+// ForceRemove removes the given id like Remove, but if it is still mounted
+// it is unmounted first instead of refused. Layers with children are still
+// refused since removing them would break the children.
+func (d *LustreDriver) ForceRemove(id string) error {
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+	return d.remove(ctx, id, true)
+}
+
+func (d *LustreDriver) remove(ctx context.Context, id string, force bool) error {
+	meta, name, err := d.unlinkLayer(ctx, id, force)
+	if err != nil || name == "" {
+		return err
+	}
+
+	// The dirs are out of the way now, what is left can be slow and
+	// doesn't need the lock
+	if d.pcc != nil && meta.PCCAttached {
+		d.pccDetach(id, name)
+	}
+	d.finishRemove(name, id, meta.Size)
+	return nil
+}
+
+// finishRemove hands the "-removing" dirs of the removal name to the
+// garbage collector. The tombstone is only written once nothing of the
+// layer is left under its id, so the garbage collector never deletes a
+// live layer, and once PCC is done with the dirs. If we die before, it
+// finds the "-removing" dirs without it.
+func (d *LustreDriver) finishRemove(name, id string, size int64) {
+	if err := d.gc.AddTombstone(name, id, size); err != nil {
+		logrus.Warnf("Failed to write tombstone of %s: %v", id, err)
+	}
+	d.gc.Trigger()
+}
+
+// unlinkLayer unmounts id, moves its dirs out of the way and removes its
+// files, after which it no longer exists. It returns the state the layer
+// had and the name of the removal its dirs were moved to, empty when a PCC
+// attach of the layer is running and finishes the removal instead.
+func (d *LustreDriver) unlinkLayer(ctx context.Context, id string, force bool) (_ *layerMeta, _ string, retErr error) {
 	// Protect the d.active from concurrent access
 	d.Lock()
 	defer d.Unlock()
 
+	if err := d.waitPending(ctx, id); err != nil {
+		return nil, "", err
+	}
+	// After waitPending, it releases the lock while it waits
+	if children := d.getChildren(id); len(children) > 0 {
+		return nil, "", &ErrLayerInUse{ID: id, Children: children}
+	}
+
 	m := d.active[id]
-	if m != nil {
-		// XXX: what does this case mean? When does this happen?
-		if m.referenceCount > 0 {
-			return nil
+	if m != nil && m.referenceCount > 0 {
+		if !force {
+			return nil, "", &ErrLayerInUse{ID: id, References: m.referenceCount}
 		}
-		// Make sure the dir is umounted first
-		if err := d.unmount(m.path); err != nil {
-			return err
+		logrus.Warnf("Force removing %s while it is mounted %d times", id, m.referenceCount)
+	}
+	// Make sure the dir is umounted first. Forced, also when the mount
+	// isn't ours, e.g. one left by the mount command.
+	if m != nil || force {
+		if err := fsOp(ctx, "unmount", d.dir(mntPath, id), func() error { return d.unmount(id) }); err != nil {
+			return nil, "", err
 		}
+		delete(d.active, id)
+	}
+
+	parents, err := d.getParentIds(id)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, "", err
 	}
-	tmpDirs := []string{
-		mntPath,
-		diffPath,
-		workPath,
+	meta, err := d.loadMeta(id)
+	if err != nil {
+		logrus.Warnf("Failed to load state of %s: %v", id, err)
+		meta = &layerMeta{}
 	}
 
-	// XXX: why? maybe we should just remove things and not care like the overlay driver does
-	// Atomically remove each directory in turn by first moving it out of the
-	// way (so that docker doesn't find it anymore) before doing removal of
-	// the whole tree.
-	for _, p := range tmpDirs {
-		realPath := d.dir(p, id)
-		tmpPath := d.dir(p, fmt.Sprintf("%s-removing", id))
-		if err := os.Rename(realPath, tmpPath); err != nil && !os.IsNotExist(err) {
-			return err
+	// Move each directory out of the way so a new layer with the same id
+	// can't see it, and leave deleting the trees to the garbage collector.
+	// Every removal gets its own name, the dirs of an earlier removal of
+	// the id may still be waiting for the garbage collector.
+	name := removalName(id)
+	d.gc.Reserve(name)
+	defer func() {
+		if retErr != nil {
+			d.gc.Unreserve(name)
+		}
+	}()
+	if err := fsOp(ctx, "remove", d.dir(diffPath, id), func() error {
+		// An immutable dir can't be renamed, the garbage collector clears
+		// the attribute of what is in it
+		if meta.Immutable {
+			if err := setImmutable(d.dir(diffPath, id), false); err != nil && !os.IsNotExist(err) {
+				return err
+			}
 		}
-		defer os.RemoveAll(tmpPath)
+		return d.renameDirs(id, name+removingSuffix)
+	}); err != nil {
+		return nil, "", err
 	}
-	// Remove the layers file for the id
+
+	// Remove the layers file for the id, after this it no longer exists
 	if err := os.Remove(d.dir(layersPath, id)); err != nil && !os.IsNotExist(err) {
-		return err
+		return nil, "", err
+	}
+	if err := os.Remove(d.dir(metaPath, id)); err != nil && !os.IsNotExist(err) {
+		return nil, "", err
+	}
+	if len(parents) > 0 {
+		d.removeChild(parents[0], id)
+	}
+	// An attach that is still running detaches what it attached from the
+	// "-removing" dirs once it is done, and finishes the removal
+	if d.pcc != nil && d.pcc.attaching[id] != nil {
+		a := d.pcc.attaching[id]
+		a.removal, a.size = name, meta.Size
+		return meta, "", nil
+	}
+	return meta, name, nil
+}
+
+// renameDirs renames the dirs of the layer from to to, renaming back the
+// ones already renamed when one fails so the layer is left intact.
+func (d *LustreDriver) renameDirs(from, to string) error {
+	for i, p := range allDirPaths {
+		if err := os.Rename(d.dir(p, from), d.dir(p, to)); err != nil && !os.IsNotExist(err) {
+			for _, p := range allDirPaths[:i] {
+				if err := os.Rename(d.dir(p, to), d.dir(p, from)); err != nil && !os.IsNotExist(err) {
+					logrus.Warnf("Failed to restore %s: %v", d.dir(p, from), err)
+				}
+			}
+			return err
+		}
 	}
 	return nil
 }
@@ -346,6 +828,14 @@ func (d *LustreDriver) Changes(id, parent string) ([]archive.Change, error) {
 
 // Get creates and mounts the required file system for the given id and returns the mount path.
 func (d *LustreDriver) Get(id string, mountLabel string) (string, error) {
+	return d.GetContext(context.Background(), id, mountLabel)
+}
+
+// GetContext is Get, giving up when ctx is done. A mount that is given up
+// on may still show up later, the next Get of the layer uses it.
+func (d *LustreDriver) GetContext(ctx context.Context, id, mountLabel string) (string, error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
 	ids, err := d.getParentIds(id)
 	if err != nil {
 		if !os.IsNotExist(err) {
@@ -354,10 +844,24 @@ func (d *LustreDriver) Get(id string, mountLabel string) (string, error) {
 		ids = []string{}
 	}
 
+	used := append([]string{id}, ids...)
+	if err := d.touchLayers(used); err != nil {
+		logrus.Warnf("Failed to record use of %s: %v", id, err)
+	}
+	// Restore released layers before taking the lock, it can take minutes
+	if d.hsm != nil {
+		if err := d.restoreLayers(ctx, used); err != nil {
+			return "", err
+		}
+	}
+
 	// Protect the d.active from concurrent access
 	d.Lock()
 	defer d.Unlock()
 
+	if err := d.waitPending(ctx, id); err != nil {
+		return "", err
+	}
 	m := d.active[id]
 	if m == nil {
 		m = &ActiveMount{}
@@ -365,14 +869,28 @@ func (d *LustreDriver) Get(id string, mountLabel string) (string, error) {
 	}
 
 	// If a dir does not have a parent ( no layers )do not try to mount
-	// just return the diff path to the data
+	// just return the diff path to the data. With idmapped mounts every
+	// layer has to be mounted to shift its ownership.
 	m.path = d.dir(diffPath, id)
-	if len(ids) > 0 {
+	if len(ids) > 0 || d.userns != nil {
 		m.path = d.dir(mntPath, id)
-		if m.referenceCount == 0 {
-			if err := d.mountID(id, mountLabel); err != nil {
+		if !m.mounted {
+			r, err := startFsOp(ctx, "mount", m.path, func() error { return d.mountID(id, mountLabel) })
+			if err != nil {
+				// The next Get waits for a mount left running
+				m.pending = r
 				return "", err
 			}
+			m.mounted = true
+			m.mountLabel = mountLabel
+			if d.pcc != nil {
+				// Once this mount is counted, before the lock is released
+				defer d.attachHotLayers(ids)
+			}
+		} else if mountLabel != "" && m.mountLabel != mountLabel {
+			// An empty label means the caller doesn't care, e.g. Changes
+			// while the container is running, so the existing mount is fine
+			return "", fmt.Errorf("layer %s is already mounted with label %q, can't mount it with label %q", id, m.mountLabel, mountLabel)
 		}
 	}
 	m.referenceCount++
@@ -390,7 +908,7 @@ const maxMountOptsLen = 4095
 
 func (d *LustreDriver) mountro(mountPath string, layers []string, mountLabel string) error {
 	logrus.Debugf("mounting ro %v %v %v", mountPath, layers, mountLabel)
-	mntOpts := label.FormatMountLabel(fmt.Sprintf("lowerdir=%s", strings.Join(layers, ":")), mountLabel)
+	mntOpts := d.formatMountLabel(fmt.Sprintf("lowerdir=%s", strings.Join(layers, ":")), mountLabel)
 	logrus.Debugf("mount opts length %d", len(mntOpts))
 	if len(mntOpts) > maxMountOptsLen {
 		logrus.Debugf("mount opts too long %d", len(mntOpts))
@@ -411,11 +929,20 @@ func (d *LustreDriver) mountPartMaxLength(id, mountLabel string) int {
 	upperDir := d.dir(diffPath, id)
 	workDir := d.dir(workPath, id)
 
-	extraStringsLength := len(label.FormatMountLabel(fmt.Sprintf("lowerdir=%s:,upperdir=%s,workdir=%s", d.formatIntermediateMountPath(id, 0), upperDir, workDir), mountLabel))
+	extraStringsLength := len(d.formatMountLabel(fmt.Sprintf("lowerdir=%s:,upperdir=%s,workdir=%s", d.formatIntermediateMountPath(id, 0), upperDir, workDir), mountLabel))
 
 	return maxMountOptsLen - extraStringsLength
 }
 
+// formatMountLabel appends the SELinux mount label to the mount options,
+// using context= or fscontext= as configured.
+func (d *LustreDriver) formatMountLabel(opts, mountLabel string) string {
+	if mountLabel == "" || !selinux.SelinuxEnabled() {
+		return opts
+	}
+	return fmt.Sprintf("%s,%s=%q", opts, d.options.labelMountOption, mountLabel)
+}
+
 type mountOptsTooLong string
 
 func (m mountOptsTooLong) Error() string {
@@ -429,7 +956,7 @@ func (d *LustreDriver) mountrw(id string, layers []string, mountLabel string) er
 	mergedDir := d.dir(mntPath, id)
 	lowerDirs := strings.Join(layers, ":")
 
-	mntOpts := label.FormatMountLabel(fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowerDirs, upperDir, workDir), mountLabel)
+	mntOpts := d.formatMountLabel(fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowerDirs, upperDir, workDir), mountLabel)
 	logrus.Debugf("mount opt length %d", len(mntOpts))
 	if len(mntOpts) > maxMountOptsLen {
 		logrus.Debugf("mount opts too long %d", len(mntOpts))
@@ -472,8 +999,22 @@ func (d *LustreDriver) mountID(id string, mountLabel string) error {
 	if err != nil {
 		return err
 	}
+	// overlay needs at least one lower dir
+	if len(layers) == 0 {
+		layers = []string{path.Join(d.root, emptyPath)}
+	}
+
+	if err := d.tryMountRW(id, layers, mountLabel, 0); err != nil {
+		return err
+	}
 
-	return d.tryMountRW(id, layers, mountLabel, 0)
+	if d.userns != nil {
+		if err := idmapMount(mergedDir, mergedDir, d.userns); err != nil {
+			d.unmount(id)
+			return err
+		}
+	}
+	return nil
 }
 
 func (d *LustreDriver) tryMountRW(id string, layers []string, mountLabel string, level int) error {
@@ -540,15 +1081,26 @@ func (d *LustreDriver) tryMountRW(id string, layers []string, mountLabel string,
 
 // Put unmounts and updates list of active mounts.
 func (d *LustreDriver) Put(id string) error {
+	return d.PutContext(context.Background(), id)
+}
+
+// PutContext is Put, giving up when ctx is done. The layer is released
+// even when its unmount is given up on.
+func (d *LustreDriver) PutContext(ctx context.Context, id string) error {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
 	// Protect the d.active from concurrent access
 	d.Lock()
 	defer d.Unlock()
 
+	if err := d.waitPending(ctx, id); err != nil {
+		return err
+	}
 	m := d.active[id]
 	if m == nil {
 		// but it might be still here
 		if d.Exists(id) {
-			if err := d.unmount(id); err != nil {
+			if err := fsOp(ctx, "unmount", d.dir(mntPath, id), func() error { return d.unmount(id) }); err != nil {
 				logrus.Debugf("Failed to unmount %s overlay: %v", id, err)
 			}
 		}
@@ -556,14 +1108,22 @@ func (d *LustreDriver) Put(id string) error {
 	}
 	if count := m.referenceCount; count > 1 {
 		m.referenceCount = count - 1
-	} else {
-		ids, _ := d.getParentIds(id)
-		// We only mounted if there are any parents
-		if ids != nil && len(ids) > 0 {
-			d.unmount(id)
+		return nil
+	}
+	m.referenceCount = 0
+	// Only layers with parents or idmapped mounts are mounted
+	if m.mounted {
+		r, err := startFsOp(ctx, "unmount", d.dir(mntPath, id), func() error { return d.unmount(id) })
+		if r != nil {
+			// The next Get waits for the unmount left running
+			m.pending = r
+			return err
+		}
+		if err != nil {
+			logrus.Debugf("Failed to unmount %s overlay: %v", id, err)
 		}
-		delete(d.active, id)
 	}
+	delete(d.active, id)
 	return nil
 }
 
@@ -583,6 +1143,13 @@ func (d *LustreDriver) getParentLayerPaths(id string) ([]string, error) {
 
 func (d *LustreDriver) unmount(id string) error {
 	logrus.Debugf("unmount %s", id)
+	// the idmapped mount is stacked on top of the overlay
+	if d.userns != nil {
+		if err := d.unmountPath(d.dir(mntPath, id)); err != nil {
+			return err
+		}
+	}
+
 	// first unmount the top mount
 	if err := d.unmountPath(d.dir(mntPath, id)); err != nil {
 		return err
@@ -621,7 +1188,53 @@ func (d *LustreDriver) Status() [][2]string {
 		{"Root Dir", d.root},
 		{"Backing Filesystem", backingFs},
 		{"Layers", fmt.Sprintf("%d", len(ids))},
+		{"Multiple Lower Dirs", fmt.Sprintf("%t", d.features.multiLower)},
+		{"Native Whiteouts", fmt.Sprintf("%t", d.features.whiteout)},
+		{"ID-mapped Mounts", fmt.Sprintf("%t", d.userns != nil)},
+		{"Pending GC Bytes", fmt.Sprintf("%d", d.gc.PendingBytes())},
+		{"Capacity Target", d.capacityStatus()},
+		{"Client Mount", d.clientStatus()},
+		{"Health", d.healthStatus()},
+	}
+}
+
+func (d *LustreDriver) clientStatus() string {
+	if d.client == nil {
+		return "none"
+	}
+	return d.client.String()
+}
+
+func (d *LustreDriver) capacityStatus() string {
+	if d.evict == nil {
+		return "none"
+	}
+	return d.evict.target.String()
+}
+
+// Layers returns every layer with its parent and the size of its diff.
+// Layers that are being removed are left out.
+func (d *LustreDriver) Layers() ([]plugindriver.LayerInfo, error) {
+	ids, err := loadIds(path.Join(d.root, layersPath))
+	if err != nil {
+		return nil, err
+	}
+	out := []plugindriver.LayerInfo{}
+	for _, id := range ids {
+		info := plugindriver.LayerInfo{ID: id}
+		parents, err := d.getParentIds(id)
+		if err != nil {
+			return nil, err
+		}
+		if len(parents) > 0 {
+			info.Parent = parents[0]
+		}
+		if info.Size, err = directory.Size(d.dir(diffPath, id)); err != nil {
+			return nil, err
+		}
+		out = append(out, info)
 	}
+	return out, nil
 }
 
 // Diff produces an archive of the changes between the specified
@@ -640,24 +1253,62 @@ func (d *LustreDriver) Diff(id, parent string) (archive.Archive, error) {
 // and its parent and returns the size in bytes of the changes
 // relative to its base filesystem directory.
 func (d *LustreDriver) DiffSize(id, parent string) (size int64, err error) {
+	return d.DiffSizeContext(context.Background(), id, parent)
+}
+
+// DiffSizeContext is DiffSize, giving up when ctx is done.
+func (d *LustreDriver) DiffSizeContext(ctx context.Context, id, parent string) (size int64, err error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
 	// overlay doesn't need the parent layer to calculate the diff size.
-	return directory.Size(d.dir(diffPath, id))
+	err = fsOp(ctx, "size", d.dir(diffPath, id), func() error {
+		var err error
+		size, err = directory.Size(d.dir(diffPath, id))
+		return err
+	})
+	return size, err
 }
 
 // ApplyDiff extracts the changeset from the given diff into the
 // layer with the specified id and parent, returning the size of the
 // new layer in bytes.
 func (d *LustreDriver) ApplyDiff(id, parent string, diff archive.Reader) (size int64, err error) {
+	return d.ApplyDiffContext(context.Background(), id, parent, diff)
+}
+
+// ApplyDiffContext is ApplyDiff, giving up when ctx is done. A diff that
+// is given up on may be partly applied.
+func (d *LustreDriver) ApplyDiffContext(ctx context.Context, id, parent string, diff archive.Reader) (size int64, err error) {
+	ctx, cancel := d.withTimeout(ctx)
+	defer cancel()
+	if err := d.checkHealthy(); err != nil {
+		return 0, err
+	}
+	layout, diff := d.chooseLayout(diff)
+	d.applyLayout(id, diffPath, layout)
+
 	// overlay doesn't need the parent id to apply the diff.
-	if err := chrootarchive.UntarUncompressed(diff, d.dir(diffPath, id), &archive.TarOptions{
-		UIDMaps:       d.uidMaps,
-		GIDMaps:       d.gidMaps,
-		OverlayFormat: true,
+	if err := fsOp(ctx, "untar", d.dir(diffPath, id), func() error {
+		return chrootarchive.UntarUncompressed(diff, d.dir(diffPath, id), &archive.TarOptions{
+			UIDMaps:       d.uidMaps,
+			GIDMaps:       d.gidMaps,
+			OverlayFormat: true,
+		})
 	}); err != nil {
 		return 0, err
 	}
 
-	return d.DiffSize(id, parent)
+	size, err = d.DiffSizeContext(ctx, id, parent)
+	if err != nil {
+		return 0, err
+	}
+	if err := d.updateMeta(id, func(m *layerMeta) { m.Size = size }); err != nil {
+		logrus.Warnf("Failed to record size of %s: %v", id, err)
+	}
+	if d.options.immutableLayers {
+		d.startCommit(id)
+	}
+	return size, nil
 }
 
 // Exists returns true if the given id is registered with
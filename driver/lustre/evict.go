@@ -0,0 +1,257 @@
+// +build linux
+
+package lustre
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	plugindriver "github.com/bacaldwell/lustre-graph-driver/driver"
+	"github.com/docker/docker/pkg/directory"
+	"github.com/docker/docker/pkg/units"
+)
+
+const defaultEvictInterval = 10 * time.Minute
+
+// capacityTarget is how much space the layers may use, either a number of
+// bytes for the layers of the driver or a percentage of the filesystem.
+type capacityTarget struct {
+	bytes   int64
+	percent float64
+}
+
+func parseCapacity(val string) (*capacityTarget, error) {
+	if strings.HasSuffix(val, "%") {
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(val, "%"), 64)
+		if err != nil || pct <= 0 || pct > 100 {
+			return nil, fmt.Errorf("invalid percentage %s", val)
+		}
+		return &capacityTarget{percent: pct}, nil
+	}
+	bytes, err := units.RAMInBytes(val)
+	if err != nil {
+		return nil, err
+	}
+	if bytes <= 0 {
+		return nil, fmt.Errorf("capacity must be positive, got %s", val)
+	}
+	return &capacityTarget{bytes: bytes}, nil
+}
+
+func (c *capacityTarget) String() string {
+	if c.percent > 0 {
+		return fmt.Sprintf("%g%%", c.percent)
+	}
+	return units.BytesSize(float64(c.bytes))
+}
+
+// evictPolicy holds the eviction settings of the driver.
+type evictPolicy struct {
+	target   *capacityTarget
+	interval time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startEvictor evicts layers every interval until stopEvictor is called.
+func (d *LustreDriver) startEvictor() {
+	e := d.evict
+	e.stop = make(chan struct{})
+	e.done = make(chan struct{})
+	go func() {
+		defer close(e.done)
+		for {
+			select {
+			case <-e.stop:
+				return
+			case <-time.After(e.interval):
+			}
+			if _, err := d.Evict(false); err != nil {
+				logrus.Errorf("lustre evict: %v", err)
+			}
+		}
+	}()
+}
+
+func (d *LustreDriver) stopEvictor() {
+	close(d.evict.stop)
+	<-d.evict.done
+}
+
+// layerSizes returns the size of the diff of every layer, as recorded when
+// it was applied if possible. It walks the other layers, so it is called
+// without the driver lock; the sizes of image layers are recorded for the
+// next time.
+func (d *LustreDriver) layerSizes() (map[string]int64, error) {
+	ids, err := loadIds(path.Join(d.root, layersPath))
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64)
+	for _, id := range ids {
+		m, err := d.loadMeta(id)
+		if err != nil {
+			return nil, err
+		}
+		if m.Size > 0 {
+			sizes[id] = m.Size
+			continue
+		}
+		size, err := directory.Size(d.dir(diffPath, id))
+		if os.IsNotExist(err) {
+			// Removed since
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sizes[id] = size
+		if !m.ReadWrite {
+			d.recordSize(id, size)
+		}
+	}
+	return sizes, nil
+}
+
+// recordSize records the size of an image layer that was applied before
+// sizes were recorded.
+func (d *LustreDriver) recordSize(id string, size int64) {
+	d.Lock()
+	defer d.Unlock()
+	// Don't leave a meta file behind if the layer was removed meanwhile
+	if !d.Exists(id) {
+		return
+	}
+	if err := d.updateMeta(id, func(m *layerMeta) { m.Size = size }); err != nil {
+		logrus.Debugf("lustre evict: failed to record size of %s: %v", id, err)
+	}
+}
+
+// usage returns how many bytes the layers use and the capacity target in
+// bytes. Only the layers of the driver count against a percentage too, the
+// filesystem may be shared with others, whose files eviction can't free.
+func (d *LustreDriver) usage(sizes map[string]int64) (used, target int64, err error) {
+	for _, size := range sizes {
+		used += size
+	}
+	t := d.evict.target
+	if t.percent > 0 {
+		var buf syscall.Statfs_t
+		if err := syscall.Statfs(d.root, &buf); err != nil {
+			return 0, 0, err
+		}
+		total := int64(buf.Blocks) * buf.Bsize
+		return used, int64(float64(total) * t.percent / 100), nil
+	}
+	return used, t.bytes, nil
+}
+
+// planEviction returns the layers to remove to get below the capacity
+// target, least recently used first. Only image layers that aren't mounted,
+// not even as the parent of a mounted layer, and have no children are
+// evicted; evicting a layer can leave its parent without children.
+// The caller must hold the driver lock.
+func (d *LustreDriver) planEviction(sizes map[string]int64) ([]plugindriver.Eviction, error) {
+	used, target, err := d.usage(sizes)
+	if err != nil {
+		return nil, err
+	}
+	if used <= target {
+		return nil, nil
+	}
+
+	var ids []string
+	for id := range sizes {
+		// Skip layers removed since they were sized
+		if d.Exists(id) {
+			ids = append(ids, id)
+		}
+	}
+	inUse := d.layersInUse()
+	children := make(map[string]int)
+	parents := make(map[string]string)
+	candidates := make(map[string]plugindriver.Eviction)
+	for _, id := range ids {
+		children[id] = len(d.getChildren(id))
+		if p, err := d.getParentIds(id); err == nil && len(p) > 0 {
+			parents[id] = p[0]
+		}
+		m, err := d.loadMeta(id)
+		if err != nil {
+			return nil, err
+		}
+		if inUse[id] || m.ReadWrite {
+			continue
+		}
+		candidates[id] = plugindriver.Eviction{ID: id, Size: sizes[id], LastUsed: m.LastUsed}
+	}
+
+	var plan []plugindriver.Eviction
+	for used > target {
+		var leaves []plugindriver.Eviction
+		for id, e := range candidates {
+			if children[id] == 0 {
+				leaves = append(leaves, e)
+			}
+		}
+		if len(leaves) == 0 {
+			break
+		}
+		sort.Sort(byLastUsed(leaves))
+		e := leaves[0]
+		plan = append(plan, e)
+		used -= e.Size
+		delete(candidates, e.ID)
+		children[parents[e.ID]]--
+	}
+	return plan, nil
+}
+
+// Evict removes least recently used image layers until the layers are
+// below the capacity target and returns them. With dryRun it only reports
+// what it would remove.
+func (d *LustreDriver) Evict(dryRun bool) ([]plugindriver.Eviction, error) {
+	if d.evict == nil {
+		return nil, fmt.Errorf("lustre: no capacity target set, see lustre.capacity")
+	}
+	sizes, err := d.layerSizes()
+	if err != nil {
+		return nil, err
+	}
+	d.Lock()
+	plan, err := d.planEviction(sizes)
+	d.Unlock()
+	if err != nil || dryRun {
+		return plan, err
+	}
+
+	evicted := []plugindriver.Eviction{}
+	for _, e := range plan {
+		// remove refuses layers that got used since the plan was made
+		ctx, cancel := d.withTimeout(context.Background())
+		err := d.remove(ctx, e.ID, false)
+		cancel()
+		if err != nil {
+			logrus.Warnf("lustre evict: not evicting %s: %v", e.ID, err)
+			continue
+		}
+		logrus.Infof("lustre evict: evicted %s (%s, last used %s)", e.ID, units.HumanSize(float64(e.Size)), e.LastUsed.Format(time.RFC3339))
+		evicted = append(evicted, e)
+	}
+	return evicted, nil
+}
+
+type byLastUsed []plugindriver.Eviction
+
+func (s byLastUsed) Len() int           { return len(s) }
+func (s byLastUsed) Less(i, j int) bool { return s[i].LastUsed.Before(s[j].LastUsed) }
+func (s byLastUsed) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,148 @@
+// +build linux
+
+package lustre
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	plugindriver "github.com/bacaldwell/lustre-graph-driver/driver"
+	mountpk "github.com/docker/docker/pkg/mount"
+)
+
+// Kinds of problems reported by Check
+const (
+	problemOrphanDir         = "orphan-dir"
+	problemMissingDir        = "missing-dir"
+	problemMissingParent     = "missing-parent"
+	problemBadMetadata       = "bad-metadata"
+	problemStaleIntermediate = "stale-intermediate"
+	problemLeftoverMount     = "leftover-mount"
+	problemModifiedLayer     = "modified-layer"
+)
+
+// intermediateMountRegexp matches the names given by formatIntermediateMountPath
+var intermediateMountRegexp = regexp.MustCompile(`^(.+)-[0-9]{2}$`)
+
+// Check scans the driver root for dirs without a layers file, layers files
+// that point at missing parents, stale intermediate mounts, mounts that no
+// Get holds and committed layers whose content changed. With repair set it
+// removes orphans, unmounts stale mounts and recreates missing dirs;
+// missing parents and modified layers can only be reported.
+//
+// The "-removing" dirs of removed layers are left to the garbage collector.
+func (d *LustreDriver) Check(repair bool) ([]plugindriver.Problem, error) {
+	problems, err := d.check(repair)
+	if err != nil {
+		return nil, err
+	}
+	// Without the lock, reading every committed layer takes a while
+	ids, err := loadIds(path.Join(d.root, layersPath))
+	if err != nil {
+		return nil, err
+	}
+	return append(problems, d.verifyLayers(ids)...), nil
+}
+
+func (d *LustreDriver) check(repair bool) ([]plugindriver.Problem, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	ids, err := loadIds(path.Join(d.root, layersPath))
+	if err != nil {
+		return nil, err
+	}
+	exists := make(map[string]bool)
+	for _, id := range ids {
+		exists[id] = true
+	}
+	problems := []plugindriver.Problem{}
+	report := func(p plugindriver.Problem, fix func() error) {
+		if repair && fix != nil {
+			if err := fix(); err != nil {
+				p.Detail = fmt.Sprintf("%s (repair failed: %v)", p.Detail, err)
+			} else {
+				p.Repaired = true
+			}
+		}
+		problems = append(problems, p)
+	}
+
+	for _, id := range ids {
+		parents, err := d.getParentIds(id)
+		if err != nil {
+			report(plugindriver.Problem{Kind: problemBadMetadata, ID: id, Path: d.dir(layersPath, id), Detail: err.Error()}, nil)
+			continue
+		}
+		for _, parent := range parents {
+			if !exists[parent] {
+				report(plugindriver.Problem{Kind: problemMissingParent, ID: id, Path: d.dir(layersPath, id),
+					Detail: fmt.Sprintf("parent %s does not exist", parent)}, nil)
+			}
+		}
+		for _, p := range allDirPaths {
+			dir := d.dir(p, id)
+			if _, err := os.Lstat(dir); os.IsNotExist(err) {
+				report(plugindriver.Problem{Kind: problemMissingDir, ID: id, Path: dir,
+					Detail: fmt.Sprintf("%s dir does not exist", p)}, func() error {
+					return d.createDirsFor(id)
+				})
+			}
+		}
+
+		mergedDir := d.dir(mntPath, id)
+		if mounted, _ := mountpk.Mounted(mergedDir); mounted && !d.isActive(id) {
+			report(plugindriver.Problem{Kind: problemLeftoverMount, ID: id, Path: mergedDir,
+				Detail: "mounted but not held by any Get"}, func() error {
+				return d.unmount(id)
+			})
+		}
+	}
+
+	for _, p := range allDirPaths {
+		fis, err := ioutil.ReadDir(path.Join(d.root, p))
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			name := fi.Name()
+			dir := d.dir(p, name)
+			if exists[name] || strings.HasSuffix(name, removingSuffix) {
+				continue
+			}
+			if m := intermediateMountRegexp.FindStringSubmatch(name); p == mntPath && m != nil && exists[m[1]] {
+				if d.isActive(m[1]) {
+					continue
+				}
+				report(plugindriver.Problem{Kind: problemStaleIntermediate, ID: m[1], Path: dir,
+					Detail: "intermediate mount dir of a layer that is not mounted"}, func() error {
+					if err := d.unmountPath(dir); err != nil {
+						return err
+					}
+					return os.Remove(dir)
+				})
+				continue
+			}
+			report(plugindriver.Problem{Kind: problemOrphanDir, ID: name, Path: dir,
+				Detail: "no layers file for this dir"}, func() error {
+				if err := d.unmountPath(dir); err != nil {
+					return err
+				}
+				return os.RemoveAll(dir)
+			})
+		}
+	}
+
+	return problems, nil
+}
+
+// isActive reports whether id is held by a Get.
+// The caller must hold the driver lock.
+func (d *LustreDriver) isActive(id string) bool {
+	m := d.active[id]
+	return m != nil && m.referenceCount > 0
+}
@@ -0,0 +1,362 @@
+// +build linux
+
+package lustre
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/directory"
+)
+
+const (
+	// removingPath holds a tombstone for every removal that isn't finished
+	removingPath = "removing"
+	// removingSuffix is appended to the name of a removal to get the name
+	// the dirs of the layer are moved to
+	removingSuffix = "-removing"
+
+	defaultGCInterval = 10 * time.Minute
+	defaultGCRate     = 1000
+)
+
+var errGCStopped = errors.New("garbage collector stopped")
+
+// tombstone is written when a layer is removed so the deletion of its dirs
+// can be finished after a crash. It is named after the removal, not the
+// layer, so removing an id that was created again doesn't clash with a
+// removal that is still pending.
+type tombstone struct {
+	ID      string
+	Size    int64
+	Created time.Time
+}
+
+// removalName returns a name for the removal of id that no other removal
+// of id has.
+func removalName(id string) string {
+	return fmt.Sprintf("%s-%d", id, time.Now().UnixNano())
+}
+
+// garbageCollector deletes the dirs of removed layers in the background.
+// Deleting a large layer on Lustre can take a long time and produces a lot
+// of MDS load, so deletion is throttled and resumed after restarts.
+type garbageCollector struct {
+	root       string
+	collecting sync.Mutex // Serializes passes
+
+	sync.Mutex // Protects interval, rate, pending and reserved
+	interval   time.Duration
+	rate       int // unlinks per second, 0 for no limit
+	pending    map[string]int64
+	reserved   map[string]bool // Removals whose dirs are still in use
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newGarbageCollector(root string, interval time.Duration, rate int) *garbageCollector {
+	return &garbageCollector{
+		root:     root,
+		interval: interval,
+		rate:     rate,
+		pending:  make(map[string]int64),
+		reserved: make(map[string]bool),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start runs the collector until Stop is called. The first pass resumes any
+// removals that were interrupted.
+func (gc *garbageCollector) Start() {
+	go func() {
+		defer close(gc.done)
+		for {
+			if err := gc.collect(); err != nil && err != errGCStopped {
+				logrus.Errorf("lustre gc: %v", err)
+			}
+			select {
+			case <-gc.stop:
+				return
+			case <-gc.wake:
+			case <-time.After(gc.getInterval()):
+			}
+		}
+	}()
+}
+
+// Stop stops the collector and waits for it to return. Pending removals
+// are resumed the next time the collector is started.
+func (gc *garbageCollector) Stop() {
+	close(gc.stop)
+	<-gc.done
+}
+
+// Trigger makes the collector run a pass without waiting for the interval.
+func (gc *garbageCollector) Trigger() {
+	select {
+	case gc.wake <- struct{}{}:
+	default:
+	}
+}
+
+// SetInterval changes how often the collector looks for work.
+func (gc *garbageCollector) SetInterval(interval time.Duration) {
+	gc.Lock()
+	gc.interval = interval
+	gc.Unlock()
+}
+
+// SetRate changes the maximum number of unlinks per second.
+func (gc *garbageCollector) SetRate(rate int) {
+	gc.Lock()
+	gc.rate = rate
+	gc.Unlock()
+}
+
+func (gc *garbageCollector) getInterval() time.Duration {
+	gc.Lock()
+	defer gc.Unlock()
+	return gc.interval
+}
+
+func (gc *garbageCollector) getRate() int {
+	gc.Lock()
+	defer gc.Unlock()
+	return gc.rate
+}
+
+// PendingBytes returns the size of the layers that still have to be deleted.
+func (gc *garbageCollector) PendingBytes() int64 {
+	gc.Lock()
+	defer gc.Unlock()
+	var total int64
+	for _, size := range gc.pending {
+		total += size
+	}
+	return total
+}
+
+// Reserve keeps the collector away from the "-removing" dirs of the
+// removal name until its tombstone is written, while they are still
+// detached from PCC.
+func (gc *garbageCollector) Reserve(name string) {
+	gc.Lock()
+	gc.reserved[name] = true
+	gc.Unlock()
+}
+
+// Unreserve gives the "-removing" dirs of the removal name to the
+// collector without a tombstone, when the removal failed half way.
+func (gc *garbageCollector) Unreserve(name string) {
+	gc.Lock()
+	delete(gc.reserved, name)
+	gc.Unlock()
+}
+
+// AddTombstone records that the dirs of the layer id were moved to the
+// "-removing" names of the removal name and have to be deleted. It ends
+// the reservation of the dirs, also when the tombstone can't be written.
+func (gc *garbageCollector) AddTombstone(name, id string, size int64) error {
+	defer gc.Unreserve(name)
+	f, err := os.Create(path.Join(gc.root, removingPath, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := json.NewEncoder(f).Encode(tombstone{ID: id, Size: size, Created: time.Now()}); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	gc.Lock()
+	gc.pending[name] = size
+	gc.Unlock()
+	return nil
+}
+
+// collect finishes the removal of every tombstoned layer and of any
+// "-removing" dirs left behind without a tombstone.
+func (gc *garbageCollector) collect() error {
+	gc.collecting.Lock()
+	defer gc.collecting.Unlock()
+
+	names, err := gc.findPending()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := gc.removeLayer(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (gc *garbageCollector) findPending() ([]string, error) {
+	fis, err := ioutil.ReadDir(path.Join(gc.root, removingPath))
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, fi := range fis {
+		name := fi.Name()
+		if err := gc.loadTombstone(name); err != nil {
+			logrus.Warnf("lustre gc: ignoring bad tombstone %s: %v", name, err)
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+
+	// Older versions or a crash before the tombstone was written can leave
+	// "-removing" dirs behind; tombstone them so they show up in Status
+	for _, p := range allDirPaths {
+		fis, err := ioutil.ReadDir(path.Join(gc.root, p))
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			if !strings.HasSuffix(fi.Name(), removingSuffix) {
+				continue
+			}
+			name := strings.TrimSuffix(fi.Name(), removingSuffix)
+			if seen[name] || gc.isReserved(name) {
+				continue
+			}
+			size, _ := directory.Size(path.Join(gc.root, diffPath, fi.Name()))
+			if err := gc.AddTombstone(name, name, size); err != nil {
+				return nil, err
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (gc *garbageCollector) isReserved(name string) bool {
+	gc.Lock()
+	defer gc.Unlock()
+	return gc.reserved[name]
+}
+
+func (gc *garbageCollector) loadTombstone(name string) error {
+	f, err := os.Open(path.Join(gc.root, removingPath, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var t tombstone
+	if err := json.NewDecoder(f).Decode(&t); err != nil {
+		return err
+	}
+	// Older versions named the tombstone after the layer
+	if name != t.ID && !strings.HasPrefix(name, t.ID+"-") {
+		return fmt.Errorf("tombstone is for %s", t.ID)
+	}
+
+	gc.Lock()
+	gc.pending[name] = t.Size
+	gc.Unlock()
+	return nil
+}
+
+// removeLayer deletes the "-removing" dirs of the removal name, then its
+// tombstone. It only touches what Remove moved out of the way, so it
+// doesn't need the driver lock and can't hit a layer created with the same
+// id since.
+func (gc *garbageCollector) removeLayer(name string) error {
+	logrus.Debugf("lustre gc: removing %s", name)
+	for _, p := range allDirPaths {
+		dir := path.Join(gc.root, p, name+removingSuffix)
+		err := gc.removeAll(dir)
+		if os.IsPermission(err) {
+			// Committed layers are immutable
+			if err := setTreeImmutable(dir, false); err != nil {
+				return err
+			}
+			err = gc.removeAll(dir)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(path.Join(gc.root, removingPath, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	gc.Lock()
+	delete(gc.pending, name)
+	gc.Unlock()
+	return nil
+}
+
+// removeAll removes p like os.RemoveAll, but with at most rate unlinks per
+// second so removing a large layer doesn't overload the MDS.
+func (gc *garbageCollector) removeAll(p string) error {
+	rate := gc.getRate()
+	if rate <= 0 {
+		return os.RemoveAll(p)
+	}
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+	return gc.removeTree(p, ticker.C)
+}
+
+func (gc *garbageCollector) removeTree(p string, tick <-chan time.Time) error {
+	fi, err := os.Lstat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.IsDir() {
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err := gc.removeTree(path.Join(p, name), tick); err != nil {
+				return err
+			}
+		}
+	}
+
+	select {
+	case <-tick:
+	case <-gc.stop:
+		return errGCStopped
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// CollectGarbage finishes every pending layer removal before returning.
+func (d *LustreDriver) CollectGarbage() error {
+	return d.gc.collect()
+}
@@ -0,0 +1,243 @@
+// +build linux
+
+package lustre
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	plugindriver "github.com/bacaldwell/lustre-graph-driver/driver"
+	"github.com/docker/docker/daemon/graphdriver"
+)
+
+const (
+	defaultHealthTimeout = 10 * time.Second
+
+	healthPath = "health" // Canary file written and read back by the health checker
+)
+
+// fsMagicLustre is LL_SUPER_MAGIC, which docker doesn't know.
+const fsMagicLustre = graphdriver.FsMagic(0x0BD00BD0)
+
+// ErrUnhealthy is returned by operations that are refused while the backing
+// filesystem is unhealthy, instead of hanging or failing half way.
+type ErrUnhealthy struct {
+	Since    time.Time
+	Problems []string
+}
+
+func (e *ErrUnhealthy) Error() string {
+	return fmt.Sprintf("lustre: filesystem is unhealthy since %s: %s", e.Since.Format(time.RFC3339), strings.Join(e.Problems, "; "))
+}
+
+// healthChecker probes the backing filesystem every interval.
+type healthChecker struct {
+	interval time.Duration
+	timeout  time.Duration // How long a probe may take
+	lustre   bool          // lfs check servers only works on Lustre
+	hung     int32         // Probes that timed out and haven't returned yet
+
+	sync.Mutex // Protects state
+	state      plugindriver.Health
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startHealthChecker checks the health every interval until
+// stopHealthChecker is called.
+func (d *LustreDriver) startHealthChecker() {
+	h := d.health
+	h.stop = make(chan struct{})
+	h.done = make(chan struct{})
+	go func() {
+		defer close(h.done)
+		for {
+			select {
+			case <-h.stop:
+				return
+			case <-time.After(h.interval):
+			}
+			d.checkHealth()
+		}
+	}()
+}
+
+func (d *LustreDriver) stopHealthChecker() {
+	close(d.health.stop)
+	<-d.health.done
+}
+
+// checkHealth runs the probes and records their problems. No new probes
+// are started while one of a previous check is still hung.
+func (d *LustreDriver) checkHealth() {
+	h := d.health
+	var problems []string
+	if n := atomic.LoadInt32(&h.hung); n > 0 {
+		problems = append(problems, fmt.Sprintf("%d probes still hung", n))
+	} else {
+		probes := []struct {
+			name string
+			fn   func() error
+		}{
+			{"statfs", d.probeStatfs},
+			{"servers", d.probeServers},
+			{"canary", d.probeCanary},
+		}
+		for _, p := range probes {
+			if p.name == "servers" && !h.lustre {
+				continue
+			}
+			if err := h.probe(p.fn); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", p.name, err))
+				if atomic.LoadInt32(&h.hung) > 0 {
+					// The others would hang too
+					break
+				}
+			}
+		}
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	healthy := len(problems) == 0
+	now := time.Now()
+	if healthy != h.state.Healthy || h.state.Since.IsZero() {
+		h.state.Since = now
+		if healthy {
+			logrus.Infof("lustre: filesystem is healthy")
+		} else {
+			logrus.Errorf("lustre: filesystem is unhealthy: %s", strings.Join(problems, "; "))
+		}
+	}
+	h.state.Healthy = healthy
+	h.state.Checked = now
+	h.state.Problems = problems
+}
+
+// probe runs fn, giving up after the timeout. A hung fn is left running and
+// counted until it returns.
+func (h *healthChecker) probe(fn func() error) error {
+	const (
+		running = iota
+		finished
+		timedOut
+	)
+	var state int32
+	errc := make(chan error, 1)
+	go func() {
+		err := fn()
+		if !atomic.CompareAndSwapInt32(&state, running, finished) {
+			atomic.AddInt32(&h.hung, -1)
+		}
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(h.timeout):
+		atomic.AddInt32(&h.hung, 1)
+		if atomic.CompareAndSwapInt32(&state, running, timedOut) {
+			return fmt.Errorf("timed out after %s", h.timeout)
+		}
+		// fn returned just now
+		atomic.AddInt32(&h.hung, -1)
+		return <-errc
+	}
+}
+
+func (d *LustreDriver) probeStatfs() error {
+	var buf syscall.Statfs_t
+	return syscall.Statfs(d.root, &buf)
+}
+
+// probeServers runs lfs check servers, which prints a line like
+// "fs-OST0000-osc-ffff8800: active" for every target.
+func (d *LustreDriver) probeServers() error {
+	out, err := d.lfs.Run("check", "servers")
+	if err != nil {
+		return err
+	}
+	var down []string
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if line != "" && !strings.HasSuffix(line, "active") {
+			down = append(down, line)
+		}
+	}
+	if len(down) > 0 {
+		return fmt.Errorf("%s", strings.Join(down, ", "))
+	}
+	return nil
+}
+
+// probeCanary writes a canary file through to the servers and reads it
+// back.
+func (d *LustreDriver) probeCanary() error {
+	canary := path.Join(d.root, healthPath)
+	data := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+	f, err := os.OpenFile(canary, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	read, err := ioutil.ReadFile(canary)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(read, data) {
+		return fmt.Errorf("read back %q, wrote %q", read, data)
+	}
+	return nil
+}
+
+// Health returns the result of the last health check. Without a health
+// checker the filesystem is assumed to be healthy.
+func (d *LustreDriver) Health() plugindriver.Health {
+	if d.health == nil {
+		return plugindriver.Health{Healthy: true}
+	}
+	d.health.Lock()
+	defer d.health.Unlock()
+	s := d.health.state
+	s.Problems = append([]string(nil), s.Problems...)
+	return s
+}
+
+// checkHealthy returns an ErrUnhealthy if the last health check failed.
+func (d *LustreDriver) checkHealthy() error {
+	if s := d.Health(); !s.Healthy {
+		return &ErrUnhealthy{Since: s.Since, Problems: s.Problems}
+	}
+	return nil
+}
+
+func (d *LustreDriver) healthStatus() string {
+	if d.health == nil {
+		return "not checked"
+	}
+	s := d.Health()
+	if s.Healthy {
+		return fmt.Sprintf("healthy since %s", s.Since.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("unhealthy since %s: %s", s.Since.Format(time.RFC3339), strings.Join(s.Problems, "; "))
+}
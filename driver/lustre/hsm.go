@@ -0,0 +1,385 @@
+// +build linux
+
+package lustre
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// HSM states of a layer, kept in its layerMeta
+const (
+	hsmOnline    = ""          // Only on Lustre
+	hsmArchiving = "archiving" // Archive requested, files still on Lustre
+	hsmArchived  = "archived"  // Archived and on Lustre
+	hsmReleased  = "released"  // Archived and released from Lustre
+)
+
+const (
+	defaultHSMAge            = 30 * 24 * time.Hour
+	defaultHSMInterval       = time.Hour
+	defaultHSMRestoreTimeout = 10 * time.Minute
+
+	// hsmPollInterval is how often restores are checked for completion
+	hsmPollInterval = time.Second
+	// hsmProgressInterval is how often restore progress is logged
+	hsmProgressInterval = 10 * time.Second
+)
+
+// hsmFileState is the HSM state of a file.
+type hsmFileState struct {
+	Archived bool
+	Released bool
+}
+
+// hsmBackend archives, releases and restores files. The driver uses lfs,
+// tests use a stub copytool.
+type hsmBackend interface {
+	Archive(files []string) error
+	Release(files []string) error
+	Restore(files []string) error
+	State(file string) (hsmFileState, error)
+}
+
+// lfsHSM is the hsmBackend of the lfs hsm_* commands. The copytool of the
+// archive does the actual copying.
+type lfsHSM struct {
+	lfs       lfsRunner
+	archiveID int // 0 for the default archive
+}
+
+func (h *lfsHSM) Archive(files []string) error {
+	args := []string{"hsm_archive"}
+	if h.archiveID != 0 {
+		args = append(args, "--archive", strconv.Itoa(h.archiveID))
+	}
+	return h.run(args, files)
+}
+
+func (h *lfsHSM) Release(files []string) error {
+	return h.run([]string{"hsm_release"}, files)
+}
+
+func (h *lfsHSM) Restore(files []string) error {
+	return h.run([]string{"hsm_restore"}, files)
+}
+
+// State parses the output of lfs hsm_state, e.g.
+// "file: (0x0000000d) released exists archived, archive_id:1"
+func (h *lfsHSM) State(file string) (hsmFileState, error) {
+	out, err := h.lfs.Run("hsm_state", file)
+	if err != nil {
+		return hsmFileState{}, err
+	}
+	var s hsmFileState
+	for _, word := range strings.Fields(strings.Replace(out, ",", " ", -1)) {
+		switch word {
+		case "archived":
+			s.Archived = true
+		case "released":
+			s.Released = true
+		}
+	}
+	return s, nil
+}
+
+func (h *lfsHSM) run(args, files []string) error {
+	return runBatched(h.lfs, args, files)
+}
+
+// hsmPolicy holds the HSM settings of the driver.
+type hsmPolicy struct {
+	backend        hsmBackend
+	age            time.Duration // Layers unused for this long are released
+	interval       time.Duration // How often cold layers are looked for
+	restoreTimeout time.Duration
+
+	archiving map[string]bool // Protected by the driver lock
+	releasing map[string]bool // Claims of releases in progress, a Get drops them. Protected by the driver lock
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startArchiver archives and releases cold layers every interval until
+// stopArchiver is called.
+func (d *LustreDriver) startArchiver() {
+	h := d.hsm
+	h.stop = make(chan struct{})
+	h.done = make(chan struct{})
+	go func() {
+		defer close(h.done)
+		for {
+			select {
+			case <-h.stop:
+				return
+			case <-time.After(h.interval):
+			}
+			if err := d.archiveColdLayers(); err != nil {
+				logrus.Errorf("lustre hsm: %v", err)
+			}
+		}
+	}()
+}
+
+func (d *LustreDriver) stopArchiver() {
+	close(d.hsm.stop)
+	<-d.hsm.done
+}
+
+// layersInUse returns the layers that are mounted, directly or as a lower
+// dir of a mounted layer. The caller must hold the driver lock.
+func (d *LustreDriver) layersInUse() map[string]bool {
+	inUse := make(map[string]bool)
+	for id, m := range d.active {
+		if m.referenceCount == 0 {
+			continue
+		}
+		inUse[id] = true
+		parents, _ := d.getParentIds(id)
+		for _, parent := range parents {
+			inUse[parent] = true
+		}
+	}
+	return inUse
+}
+
+// isCold reports whether id is unused and wasn't used for the HSM age. The
+// caller must hold the driver lock.
+func (d *LustreDriver) isCold(id string, inUse map[string]bool) (bool, error) {
+	if inUse[id] {
+		return false, nil
+	}
+	m, err := d.loadMeta(id)
+	if err != nil {
+		return false, err
+	}
+	// Layers from before last use was recorded start their clock now
+	if m.LastUsed.IsZero() {
+		return false, d.touchLayers([]string{id})
+	}
+	return time.Since(m.LastUsed) >= d.hsm.age, nil
+}
+
+// archiveColdLayers moves every cold layer one step towards being
+// released: archiving is requested first, and once the copytool archived
+// every file they are released.
+func (d *LustreDriver) archiveColdLayers() error {
+	ids, err := loadIds(filepath.Join(d.root, layersPath))
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := d.archiveLayer(id); err != nil {
+			logrus.Warnf("lustre hsm: archiving %s failed: %v", id, err)
+		}
+	}
+	return nil
+}
+
+func (d *LustreDriver) archiveLayer(id string) error {
+	// Claim the layer under the lock; walking it and asking for the state
+	// of every file takes long on a large layer, so that is done without.
+	d.Lock()
+	cold, err := d.isCold(id, d.layersInUse())
+	if err != nil || !cold || d.hsm.archiving[id] {
+		d.Unlock()
+		return err
+	}
+	d.hsm.archiving[id] = true
+	d.Unlock()
+	defer func() {
+		d.Lock()
+		delete(d.hsm.archiving, id)
+		d.Unlock()
+	}()
+
+	m, err := d.loadMeta(id)
+	if err != nil {
+		return err
+	}
+	files, err := d.layerFiles(id)
+	if err != nil || len(files) == 0 {
+		return err
+	}
+
+	switch m.HSMState {
+	case hsmOnline:
+		logrus.Debugf("lustre hsm: archiving %s", id)
+		if err := d.hsm.backend.Archive(files); err != nil {
+			return err
+		}
+		d.Lock()
+		defer d.Unlock()
+		return d.recordHSMState(id, hsmArchiving)
+	case hsmArchiving, hsmArchived:
+		for _, f := range files {
+			s, err := d.hsm.backend.State(f)
+			if err != nil {
+				return err
+			}
+			if !s.Archived {
+				// Not done yet, or changed since it was archived
+				if m.HSMState == hsmArchived {
+					d.Lock()
+					defer d.Unlock()
+					return d.recordHSMState(id, hsmOnline)
+				}
+				return nil
+			}
+		}
+		return d.releaseLayer(id, files)
+	}
+	return nil
+}
+
+// releaseLayer releases files, those of id, if the layer is still cold.
+// Releasing a large layer takes a while, so it is claimed under the lock
+// and released without. A Get restores the released layers it uses before
+// it takes the lock, so it drops the claim first; a release that lost its
+// claim restores what it released instead of recording the layer as
+// released.
+func (d *LustreDriver) releaseLayer(id string, files []string) error {
+	d.Lock()
+	cold, err := d.isCold(id, d.layersInUse())
+	if err != nil || !cold {
+		d.Unlock()
+		return err
+	}
+	d.hsm.releasing[id] = true
+	d.Unlock()
+
+	logrus.Debugf("lustre hsm: releasing %s", id)
+	err = d.hsm.backend.Release(files)
+
+	d.Lock()
+	claimed := d.hsm.releasing[id]
+	delete(d.hsm.releasing, id)
+	if claimed && err == nil {
+		err = d.recordHSMState(id, hsmReleased)
+	}
+	d.Unlock()
+	if !claimed {
+		logrus.Debugf("lustre hsm: %s was used while it was released, restoring it", id)
+		return d.hsm.backend.Restore(files)
+	}
+	return err
+}
+
+// recordHSMState records state if id still exists. The caller must hold
+// the driver lock.
+func (d *LustreDriver) recordHSMState(id, state string) error {
+	// Don't leave a meta file behind if the layer was removed meanwhile
+	if !d.Exists(id) {
+		return nil
+	}
+	return d.setHSMState(id, state)
+}
+
+// restoreLayers restores the released layers among ids and waits until
+// every file is back on Lustre, the restore timeout expires or ctx is done.
+// The caller must not hold the driver lock.
+func (d *LustreDriver) restoreLayers(ctx context.Context, ids []string) error {
+	// A release in progress can't be seen in the state yet, drop its claim
+	// so it restores the layer itself
+	d.Lock()
+	for _, id := range ids {
+		if d.hsm.releasing[id] {
+			d.hsm.releasing[id] = false
+		}
+	}
+	d.Unlock()
+
+	var released []string
+	pending := make(map[string]bool)
+	for _, id := range ids {
+		m, err := d.loadMeta(id)
+		if err != nil {
+			return err
+		}
+		if m.HSMState != hsmReleased {
+			continue
+		}
+		files, err := d.layerFiles(id)
+		if err != nil {
+			return err
+		}
+		if err := d.hsm.backend.Restore(files); err != nil {
+			return err
+		}
+		released = append(released, id)
+		for _, f := range files {
+			pending[f] = true
+		}
+	}
+	if len(released) == 0 {
+		return nil
+	}
+
+	total := len(pending)
+	logrus.Infof("lustre hsm: restoring %d files of %s", total, strings.Join(released, ", "))
+	start := time.Now()
+	lastProgress := start
+	for len(pending) > 0 {
+		for f := range pending {
+			s, err := d.hsm.backend.State(f)
+			if err != nil {
+				return err
+			}
+			if !s.Released {
+				delete(pending, f)
+			}
+		}
+		if len(pending) == 0 {
+			break
+		}
+		if time.Since(start) >= d.hsm.restoreTimeout {
+			return fmt.Errorf("lustre: restoring %s timed out after %s with %d of %d files restored",
+				strings.Join(released, ", "), d.hsm.restoreTimeout, total-len(pending), total)
+		}
+		if time.Since(lastProgress) >= hsmProgressInterval {
+			logrus.Infof("lustre hsm: restored %d of %d files of %s", total-len(pending), total, strings.Join(released, ", "))
+			lastProgress = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+			return ctxError(ctx, "restore", strings.Join(released, ", "))
+		case <-time.After(hsmPollInterval):
+		}
+	}
+	logrus.Infof("lustre hsm: restored %s in %s", strings.Join(released, ", "), time.Since(start))
+
+	for _, id := range released {
+		if err := d.setHSMState(id, hsmArchived); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *LustreDriver) setHSMState(id, state string) error {
+	return d.updateMeta(id, func(m *layerMeta) { m.HSMState = state })
+}
+
+// layerFiles returns the regular files with data in the diff dir of id,
+// the files HSM can release.
+func (d *LustreDriver) layerFiles(id string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(d.dir(diffPath, id), func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() && fi.Size() > 0 {
+			files = append(files, p)
+		}
+		return nil
+	})
+	return files, err
+}
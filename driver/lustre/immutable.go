@@ -0,0 +1,211 @@
+// +build linux
+
+package lustre
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	plugindriver "github.com/bacaldwell/lustre-graph-driver/driver"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	errImmutableUnsupported  = errors.New("the filesystem doesn't support the immutable attribute")
+	errImmutableNotPermitted = errors.New("setting the immutable attribute needs CAP_LINUX_IMMUTABLE")
+)
+
+// setImmutable sets or clears the immutable attribute of p, which must be a
+// regular file or a dir.
+func setImmutable(p string, immutable bool) error {
+	f, err := os.OpenFile(p, os.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	flags, err := unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return ioctlError(f, err)
+	}
+	if immutable {
+		flags |= unix.FS_IMMUTABLE_FL
+	} else {
+		flags &^= unix.FS_IMMUTABLE_FL
+	}
+	return ioctlError(f, unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, int(flags)))
+}
+
+func ioctlError(f *os.File, err error) error {
+	switch err {
+	case nil:
+		return nil
+	case unix.ENOTTY, unix.EOPNOTSUPP, unix.EINVAL:
+		return errImmutableUnsupported
+	case unix.EPERM:
+		return errImmutableNotPermitted
+	}
+	return &os.PathError{Op: "ioctl", Path: f.Name(), Err: err}
+}
+
+// setTreeImmutable sets or clears the immutable attribute of every file and
+// dir in the tree at root. Other files can't be opened safely, they are
+// protected by the attribute of their dir.
+func setTreeImmutable(root string, immutable bool) error {
+	return filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() && !fi.IsDir() {
+			return nil
+		}
+		return setImmutable(p, immutable)
+	})
+}
+
+// layerDigest returns the digest of the content of the tree at root: the
+// path, mode, owner and content of every entry below root. Times are left
+// out, reading files can change them.
+func layerDigest(root string) (string, error) {
+	h := sha256.New()
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root {
+			// Its permissions are taken away on commit
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		fmt.Fprintf(h, "%q %o %d %d %d\n", rel, fi.Mode(), st.Uid, st.Gid, st.Rdev)
+
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%q\n", target)
+		case fi.Mode().IsRegular():
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%d\n", fi.Size())
+			_, err = io.Copy(h, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), nil
+}
+
+// commitLayer makes the diff of id read-only once nothing should write to
+// it anymore: the digest of its content is recorded for verifyLayers, the
+// diff dir loses its write permissions and every file and dir in it gets
+// the immutable attribute where the filesystem supports it.
+func (d *LustreDriver) commitLayer(id string) error {
+	m, err := d.loadMeta(id)
+	if err != nil || m.Digest != "" {
+		return err
+	}
+	dir := d.dir(diffPath, id)
+	digest, err := layerDigest(dir)
+	if err != nil {
+		return err
+	}
+
+	// Freeze it holding the lock, so a Get can't mount it read-write
+	// meanwhile
+	d.Lock()
+	defer d.Unlock()
+	if d.isActive(id) {
+		logrus.Warnf("lustre: not committing %s, it is mounted", id)
+		return nil
+	}
+	if !d.Exists(id) {
+		// Removed since
+		return nil
+	}
+	if m, err := d.loadMeta(id); err != nil || m.Digest != "" {
+		return err
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(dir, fi.Mode().Perm()&^0222); err != nil {
+		return err
+	}
+
+	immutable := true
+	if err := setTreeImmutable(dir, true); err != nil {
+		if err != errImmutableUnsupported && err != errImmutableNotPermitted {
+			return err
+		}
+		logrus.Warnf("lustre: %s is only protected by its permissions: %v", id, err)
+		immutable = false
+	}
+	logrus.Debugf("lustre: committed %s with digest %s", id, digest)
+	return d.updateMeta(id, func(m *layerMeta) {
+		m.Digest = digest
+		m.Immutable = immutable
+	})
+}
+
+// startCommit commits id in the background, once its diff was applied or
+// a layer was created on it. Digesting a large layer takes too long to
+// make the request wait for it.
+func (d *LustreDriver) startCommit(id string) {
+	d.commits.Add(1)
+	go func() {
+		defer d.commits.Done()
+		if err := d.commitLayer(id); err != nil {
+			logrus.Warnf("lustre: failed to commit %s: %v", id, err)
+		}
+	}()
+}
+
+// verifyLayers compares the content of every committed layer among ids with
+// the digest recorded when it was committed.
+func (d *LustreDriver) verifyLayers(ids []string) []plugindriver.Problem {
+	problems := []plugindriver.Problem{}
+	for _, id := range ids {
+		m, err := d.loadMeta(id)
+		if err != nil || m.Digest == "" {
+			continue
+		}
+		digest, err := layerDigest(d.dir(diffPath, id))
+		if os.IsNotExist(err) {
+			// Removed since
+			continue
+		}
+		var detail string
+		switch {
+		case err != nil:
+			detail = fmt.Sprintf("can't compute digest: %v", err)
+		case digest != m.Digest:
+			detail = fmt.Sprintf("content digest is %s, committed as %s", digest, m.Digest)
+		default:
+			continue
+		}
+		problems = append(problems, plugindriver.Problem{Kind: problemModifiedLayer, ID: id, Path: d.dir(diffPath, id), Detail: detail})
+	}
+	return problems
+}
@@ -0,0 +1,56 @@
+// +build linux
+
+package lustre
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// lfsRunner runs the lfs tool. The driver never calls lfs directly so tests,
+// which don't run on Lustre, can record the commands instead.
+type lfsRunner interface {
+	Run(args ...string) (string, error)
+}
+
+// execLfs runs the lfs binary found in PATH.
+type execLfs struct{}
+
+func (execLfs) Run(args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("lfs", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("lfs %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// lfsBatch is the number of files passed to one lfs command
+const lfsBatch = 100
+
+// runBatched runs lfs with args on files, a batch of files at a time.
+func runBatched(lfs lfsRunner, args, files []string) error {
+	for len(files) > 0 {
+		n := len(files)
+		if n > lfsBatch {
+			n = lfsBatch
+		}
+		if _, err := lfs.Run(append(args, files[:n]...)...); err != nil {
+			return err
+		}
+		files = files[n:]
+	}
+	return nil
+}
+
+// setstripe sets the default layout of the dir p, which new files and dirs
+// created in it inherit.
+func (d *LustreDriver) setstripe(p string, layout []string) error {
+	args := append([]string{"setstripe"}, layout...)
+	_, err := d.lfs.Run(append(args, p)...)
+	return err
+}
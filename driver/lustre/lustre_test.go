@@ -3,28 +3,1522 @@
 package lustre
 
 import (
-	"github.com/bacaldwell/lustre-graph-driver/driver/graphtest"
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
+
+	plugindriver "github.com/bacaldwell/lustre-graph-driver/driver"
+	"github.com/bacaldwell/lustre-graph-driver/driver/graphtest"
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/docker/pkg/idtools"
+	mountpk "github.com/docker/docker/pkg/mount"
+	"github.com/opencontainers/runc/libcontainer/selinux"
 )
 
 // This avoids creating a new driver for each test if all tests are run
 // Make sure to put new tests between TestLustreSetup and TestLustreTeardown
 func TestLustreSetup(t *testing.T) {
-	graphtest.GetDriver(t, "Lustre")
+	graphtest.GetDriver(t, "lustre")
 }
 
 func TestLustreCreateEmpty(t *testing.T) {
-	graphtest.DriverTestCreateEmpty(t, "Lustre")
+	graphtest.DriverTestCreateEmpty(t, "lustre")
 }
 
 func TestLustreCreateBase(t *testing.T) {
-	graphtest.DriverTestCreateBase(t, "Lustre")
+	graphtest.DriverTestCreateBase(t, "lustre")
 }
 
 func TestLustreCreateSnap(t *testing.T) {
-	graphtest.DriverTestCreateSnap(t, "Lustre")
+	graphtest.DriverTestCreateSnap(t, "lustre")
+}
+
+func TestLustreRemappedCreate(t *testing.T) {
+	graphtest.DriverTestRemappedCreate(t, "lustre")
+}
+
+func TestLustreRemappedApplyDiff(t *testing.T) {
+	graphtest.DriverTestRemappedApplyDiff(t, "lustre")
+}
+
+// Host ids the remapped tests map container root to
+const (
+	remappedUID = 100000
+	remappedGID = 200000
+)
+
+func TestLustreRemappedRoot(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Creating remapped roots needs root")
+	}
+	root, err := ioutil.TempDir("/var/tmp", "lustre-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	uidMaps := []idtools.IDMap{{ContainerID: 0, HostID: remappedUID, Size: 65536}}
+	gidMaps := []idtools.IDMap{{ContainerID: 0, HostID: remappedGID, Size: 65536}}
+	subroot, err := remappedRoot(root, uidMaps, gidMaps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := path.Join(root, "100000.200000"); subroot != expected {
+		t.Fatalf("Expected subroot %s, got %s", expected, subroot)
+	}
+	verifyOwner(t, subroot, remappedUID, remappedGID)
+	for dir, mode := range map[string]os.FileMode{root: 0701, subroot: 0700} {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != mode {
+			t.Fatalf("Expected %s to have mode %v, got %v", dir, mode, fi.Mode().Perm())
+		}
+	}
+	// Creating it again is fine
+	if _, err := remappedRoot(root, uidMaps, gidMaps); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLustreIDMappedMounts(t *testing.T) {
+	d, root := newRemappedTestDriver(t, "lustre.idmapped_mounts=true")
+	defer os.RemoveAll(root)
+	defer cleanupTestDriver(t, d)
+	if d.userns == nil {
+		t.Skip("idmapped mounts are not supported")
+	}
+	// Layers are shared between mappings, so they are kept in the top root
+	if d.root != root {
+		t.Fatalf("Expected root %s, got %s", root, d.root)
+	}
+
+	if err := d.Create("idmapped", "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	verifyOwner(t, d.dir(diffPath, "idmapped"), 0, 0)
+	dir, err := d.Get("idmapped", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Put("idmapped")
+	verifyOwner(t, dir, remappedUID, remappedGID)
+}
+
+func TestLustreMountLabel(t *testing.T) {
+	for _, c := range []struct {
+		option, expected string
+	}{
+		{"", "context"},
+		{"lustre.label_mount_option=context", "context"},
+		{"lustre.label_mount_option=fscontext", "fscontext"},
+		{"lustre.label_mount_option=rootcontext", ""},
+	} {
+		var options []string
+		if c.option != "" {
+			options = append(options, c.option)
+		}
+		o, err := parseOptions(options)
+		if c.expected == "" {
+			if err == nil {
+				t.Errorf("Expected %s to be rejected", c.option)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if o.labelMountOption != c.expected {
+			t.Errorf("Expected %q to select %s, got %s", c.option, c.expected, o.labelMountOption)
+		}
+
+		d := &LustreDriver{options: o}
+		if opts := d.formatMountLabel("lowerdir=/a", ""); opts != "lowerdir=/a" {
+			t.Errorf("Expected no label option without a label, got %s", opts)
+		}
+		expected := "lowerdir=/a"
+		if selinux.SelinuxEnabled() {
+			expected += "," + c.expected + `="system_u:object_r:svirt_sandbox_file_t:s0"`
+		}
+		if opts := d.formatMountLabel("lowerdir=/a", "system_u:object_r:svirt_sandbox_file_t:s0"); opts != expected {
+			t.Errorf("Expected %s, got %s", expected, opts)
+		}
+	}
+}
+
+func TestLustreMountLabelConflict(t *testing.T) {
+	if selinux.SelinuxEnabled() {
+		t.Skip("Made up labels can't be mounted with SELinux enabled")
+	}
+	d, _ := newTestDriver(t)
+	defer cleanupTestDriver(t, d)
+
+	if err := d.Create("labelled", "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get("labelled", "label-a"); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Put("labelled")
+	metadata, err := d.GetMetadata("labelled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata["mountLabel"] != "label-a" {
+		t.Fatalf("Expected mountLabel label-a, got %q", metadata["mountLabel"])
+	}
+
+	// Without a label the existing mount is reused
+	if _, err := d.Get("labelled", ""); err != nil {
+		t.Fatal(err)
+	}
+	d.Put("labelled")
+	if _, err := d.Get("labelled", "label-b"); err == nil {
+		d.Put("labelled")
+		t.Fatal("Expected mounting with a different label to fail")
+	}
+}
+
+func TestLustrePoolPlacement(t *testing.T) {
+	d, lfs := newTestDriver(t, "lustre.image_pool=hdd", "lustre.container_pool=flash", "lustre.work_pool=flash")
+	defer cleanupTestDriver(t, d)
+
+	if err := d.Create("base", "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateReadWrite("rw", "base", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateReadWrite("fast", "base", "", map[string]string{"pool": "nvme"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateReadWrite("bad", "base", "", map[string]string{"size": "10G"}); err == nil {
+		t.Fatal("Expected unsupported storage option to fail")
+	}
+
+	expected := [][]string{
+		{"setstripe", "-p", "hdd", d.dir(diffPath, "base")},
+		{"setstripe", "-p", "flash", d.dir(diffPath, "rw")},
+		{"setstripe", "-p", "flash", d.dir(workPath, "rw")},
+		{"setstripe", "-p", "nvme", d.dir(diffPath, "fast")},
+		{"setstripe", "-p", "flash", d.dir(workPath, "fast")},
+	}
+	if !reflect.DeepEqual(lfs.commands, expected) {
+		t.Fatalf("Expected lfs commands %v, got %v", expected, lfs.commands)
+	}
+
+	metadata, err := d.GetMetadata("fast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata["layout"] != "-p nvme" || metadata["workLayout"] != "-p flash" {
+		t.Fatalf("Unexpected layouts in metadata: %v", metadata)
+	}
+}
+
+func TestLustreSampleDiff(t *testing.T) {
+	diff := layerTar(t, 3, 1)
+	s, r := sampleDiff(bytes.NewReader(diff), domAlign)
+	if s.files != 4 || s.small != 3 {
+		t.Fatalf("Expected 4 files, 3 of them small, got %+v", s)
+	}
+	// The sampled start of the diff is read again
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, diff) {
+		t.Fatal("Expected the whole diff after sampling")
+	}
+
+	s, r = sampleDiff(strings.NewReader("not a tar"), domAlign)
+	if s.files != 0 {
+		t.Fatalf("Expected no files in a broken diff, got %+v", s)
+	}
+	if b, _ := ioutil.ReadAll(r); string(b) != "not a tar" {
+		t.Fatalf("Expected the broken diff to be passed on, got %q", b)
+	}
+}
+
+func TestLustreChooseLayout(t *testing.T) {
+	dom := []string{"lustre.dom=true", "lustre.dom_min_files=4", "lustre.dom_ratio=0.75"}
+	for _, c := range []struct {
+		name       string
+		options    []string
+		small, big int
+		expected   []string
+	}{
+		{"disabled", nil, 10, 0, nil},
+		{"small files", dom, 3, 1, []string{"-E", "65536", "-L", "mdt", "-E", "-1"}},
+		{"image pool", append(dom, "lustre.image_pool=hdd"), 4, 0, []string{"-E", "65536", "-L", "mdt", "-E", "-1", "-p", "hdd"}},
+		{"dom size", append(dom, "lustre.dom_size=128K"), 4, 0, []string{"-E", "131072", "-L", "mdt", "-E", "-1"}},
+		{"too few files", dom, 3, 0, nil},
+		{"too many big files", dom, 2, 2, nil},
+	} {
+		o, err := parseOptions(c.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := &LustreDriver{options: o}
+		layout, _ := d.chooseLayout(bytes.NewReader(layerTar(t, c.small, c.big)))
+		if !reflect.DeepEqual(layout, c.expected) {
+			t.Errorf("%s: expected layout %v, got %v", c.name, c.expected, layout)
+		}
+	}
+
+	for _, option := range []string{"lustre.dom_size=100K", "lustre.dom_size=0", "lustre.dom_ratio=0", "lustre.dom_ratio=1.5", "lustre.dom_min_files=many"} {
+		if _, err := parseOptions([]string{option}); err == nil {
+			t.Errorf("Expected %s to be rejected", option)
+		}
+	}
+}
+
+func TestLustreDoMApplyDiff(t *testing.T) {
+	d, lfs := newTestDriver(t, "lustre.dom=true", "lustre.dom_min_files=2")
+	defer cleanupTestDriver(t, d)
+
+	if err := d.Create("small", "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.ApplyDiff("small", "", bytes.NewReader(layerTar(t, 2, 0))); err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{{"setstripe", "-E", "65536", "-L", "mdt", "-E", "-1", d.dir(diffPath, "small")}}
+	if !reflect.DeepEqual(lfs.commands, expected) {
+		t.Fatalf("Expected lfs commands %v, got %v", expected, lfs.commands)
+	}
+	metadata, err := d.GetMetadata("small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata["layout"] != "-E 65536 -L mdt -E -1" {
+		t.Fatalf("Unexpected layout in metadata: %v", metadata)
+	}
+}
+
+// layerTar returns a layer diff with small files of 1KiB and big files of
+// 1MiB.
+func layerTar(t *testing.T, small, big int) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < small+big; i++ {
+		size := 1024
+		if i >= small {
+			size = 1024 * 1024
+		}
+		hdr := &tar.Header{Name: fmt.Sprintf("dir/file%d", i), Typeflag: tar.TypeReg, Mode: 0644, Size: int64(size)}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestLustreParsePFL(t *testing.T) {
+	for _, c := range []struct {
+		template string
+		expected []pflComponent
+		layout   []string
+	}{
+		{"-1", []pflComponent{{end: -1}}, []string{"-E", "-1"}},
+		{"eof:4", []pflComponent{{end: -1, count: 4}}, []string{"-E", "-1", "-c", "4"}},
+		{
+			"4M:1,1G:4:flash,-1:-1:capacity",
+			[]pflComponent{{end: 4 << 20, count: 1}, {end: 1 << 30, count: 4, pool: "flash"}, {end: -1, count: -1, pool: "capacity"}},
+			[]string{"-E", "4194304", "-c", "1", "-E", "1073741824", "-c", "4", "-p", "flash", "-E", "-1", "-c", "-1", "-p", "capacity"},
+		},
+		{"64K::mdt_pool,-1", []pflComponent{{end: 64 << 10, pool: "mdt_pool"}, {end: -1}}, []string{"-E", "65536", "-p", "mdt_pool", "-E", "-1"}},
+		// Invalid templates
+		{"", nil, nil},
+		{"4M:1", nil, nil},
+		{"-1,4M", nil, nil},
+		{"4M,1M,-1", nil, nil},
+		{"100K,-1", nil, nil},
+		{"4M:many,-1", nil, nil},
+		{"4M:-2,-1", nil, nil},
+		{"4M:1:bad/pool,-1", nil, nil},
+		{"4M:1:flash:extra,-1", nil, nil},
+	} {
+		components, err := parsePFL(c.template)
+		if c.expected == nil {
+			if err == nil {
+				t.Errorf("Expected %q to be rejected", c.template)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", c.template, err)
+			continue
+		}
+		if !reflect.DeepEqual(components, c.expected) {
+			t.Errorf("%q: expected %+v, got %+v", c.template, c.expected, components)
+		}
+		if layout := pflLayout(components); !reflect.DeepEqual(layout, c.layout) {
+			t.Errorf("%q: expected layout %v, got %v", c.template, c.layout, layout)
+		}
+	}
+}
+
+func TestLustrePFLCreate(t *testing.T) {
+	d, lfs := newTestDriver(t, "lustre.pfl=4M:1,-1:-1")
+	defer cleanupTestDriver(t, d)
+
+	if err := d.Create("base", "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{{"setstripe", "-E", "4194304", "-c", "1", "-E", "-1", "-c", "-1", d.dir(diffPath, "base")}}
+	if !reflect.DeepEqual(lfs.commands, expected) {
+		t.Fatalf("Expected lfs commands %v, got %v", expected, lfs.commands)
+	}
+	if _, err := parseOptions([]string{"lustre.pfl=4M:1"}); err == nil {
+		t.Fatal("Expected a template that doesn't reach the end of file to be rejected")
+	}
+}
+
+func TestLustreHSMReleaseAndRestore(t *testing.T) {
+	d, _ := newTestDriver(t, "lustre.hsm=true", "lustre.hsm_age=1ms", "lustre.hsm_interval=1h")
+	defer cleanupTestDriver(t, d)
+	copytool := newStubCopytool()
+	d.hsm.backend = copytool
+
+	if err := d.Create("cold", "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	file := path.Join(d.dir(diffPath, "cold"), "data")
+	if err := ioutil.WriteFile(file, []byte("cold data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Create("top", "cold", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// The first pass archives, the second releases
+	for _, state := range []string{hsmArchiving, hsmReleased} {
+		if err := d.archiveColdLayers(); err != nil {
+			t.Fatal(err)
+		}
+		metadata, err := d.GetMetadata("cold")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if metadata["hsmState"] != state {
+			t.Fatalf("Expected HSM state %q, got %q", state, metadata["hsmState"])
+		}
+	}
+
+	if _, err := d.Get("top", ""); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Put("top")
+	if !reflect.DeepEqual(copytool.restores, []string{file}) {
+		t.Fatalf("Expected %s to be restored, got %v", file, copytool.restores)
+	}
+	metadata, err := d.GetMetadata("cold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata["hsmState"] != hsmArchived {
+		t.Fatalf("Expected HSM state %q after Get, got %q", hsmArchived, metadata["hsmState"])
+	}
+}
+
+// blockingCopytool is a stubCopytool whose releases wait until proceed is
+// closed.
+type blockingCopytool struct {
+	*stubCopytool
+	releasing chan struct{}
+	proceed   chan struct{}
+}
+
+func (c *blockingCopytool) Release(files []string) error {
+	close(c.releasing)
+	<-c.proceed
+	return c.stubCopytool.Release(files)
+}
+
+func TestLustreHSMReleaseRace(t *testing.T) {
+	d, _ := newTestDriver(t, "lustre.hsm=true", "lustre.hsm_age=1ms", "lustre.hsm_interval=1h")
+	defer cleanupTestDriver(t, d)
+	copytool := &blockingCopytool{newStubCopytool(), make(chan struct{}), make(chan struct{})}
+	d.hsm.backend = copytool
+
+	if err := d.Create("cold", "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	file := path.Join(d.dir(diffPath, "cold"), "data")
+	if err := ioutil.WriteFile(file, []byte("cold data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := d.archiveColdLayers(); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() { done <- d.archiveColdLayers() }()
+	<-copytool.releasing
+	// The release doesn't hold the lock, and a Get meanwhile makes it
+	// restore the layer instead of recording it as released
+	if _, err := d.Get("cold", ""); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Put("cold")
+	close(copytool.proceed)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(copytool.restores, []string{file}) {
+		t.Fatalf("Expected %s to be restored, got %v", file, copytool.restores)
+	}
+	metadata, err := d.GetMetadata("cold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata["hsmState"] == hsmReleased {
+		t.Fatal("Expected a layer used while it was released not to be recorded as released")
+	}
+}
+
+func TestLustreEvictLRU(t *testing.T) {
+	d, _ := newTestDriver(t, "lustre.capacity=150")
+	defer cleanupTestDriver(t, d)
+
+	// a is the oldest, but it can't go before its child b
+	now := time.Now()
+	for _, l := range []struct {
+		id, parent string
+		age        time.Duration
+	}{
+		{"a", "", 3 * time.Hour},
+		{"b", "a", time.Hour},
+		{"c", "", 2 * time.Hour},
+	} {
+		if err := d.Create(l.id, l.parent, "", nil); err != nil {
+			t.Fatal(err)
+		}
+		lastUsed := now.Add(-l.age)
+		if err := d.updateMeta(l.id, func(m *layerMeta) { m.Size, m.LastUsed = 100, lastUsed }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.CreateReadWrite("rw", "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dryRun := range []bool{true, false} {
+		evictions, err := d.Evict(dryRun)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, e := range evictions {
+			ids = append(ids, e.ID)
+		}
+		if !reflect.DeepEqual(ids, []string{"c", "b"}) {
+			t.Fatalf("Expected to evict c and b, got %v", ids)
+		}
+	}
+	for id, exists := range map[string]bool{"a": true, "b": false, "c": false, "rw": true} {
+		if d.Exists(id) != exists {
+			t.Fatalf("Expected %s to exist: %t", id, exists)
+		}
+	}
+}
+
+func TestLustrePCCAttachHotLayers(t *testing.T) {
+	d, lfs := newTestDriver(t, "lustre.pcc=true", "lustre.pcc_threshold=2", "lustre.pcc_archive_id=1")
+	defer cleanupTestDriver(t, d)
+
+	if err := d.Create("base", "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	file := path.Join(d.dir(diffPath, "base"), "data")
+	if err := ioutil.WriteFile(file, []byte("hot data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"c1", "c2"} {
+		if err := d.CreateReadWrite(id, "base", "", nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.Get(id, ""); err != nil {
+			t.Fatal(err)
+		}
+		d.pcc.wg.Wait()
+		if attached := len(lfs.commands) > 0; attached != (id == "c2") {
+			t.Fatalf("Expected base to be attached only once mounted twice, got %v after mounting %s", lfs.commands, id)
+		}
+	}
+
+	for _, id := range []string{"c1", "c2"} {
+		if err := d.Put(id); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Remove(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Remove("base"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{
+		{"pcc", "attach", "-i", "1", file},
+		{"pcc", "detach", "base-removing/data"},
+	}
+	// The removal name of base isn't known here, only compare its suffix
+	if len(lfs.commands) == 2 && len(lfs.commands[1]) == 3 {
+		detached := lfs.commands[1][2]
+		if strings.HasPrefix(detached, d.dir(diffPath, "base-")) && strings.HasSuffix(detached, removingSuffix+"/data") {
+			lfs.commands[1][2] = "base-removing/data"
+		}
+	}
+	if !reflect.DeepEqual(lfs.commands, expected) {
+		t.Fatalf("Expected lfs commands %v, got %v", expected, lfs.commands)
+	}
+}
+
+// blockingLfs is a fakeLfs whose pcc attach waits until proceed is closed.
+type blockingLfs struct {
+	fakeLfs
+	attaching chan struct{}
+	proceed   chan struct{}
+}
+
+func (f *blockingLfs) Run(args ...string) (string, error) {
+	if len(args) > 1 && args[0] == "pcc" && args[1] == "attach" {
+		close(f.attaching)
+		<-f.proceed
+	}
+	return f.fakeLfs.Run(args...)
+}
+
+func TestLustrePCCRemoveWhileAttaching(t *testing.T) {
+	d, _ := newTestDriver(t, "lustre.pcc=true", "lustre.pcc_threshold=1", "lustre.pcc_archive_id=1")
+	defer cleanupTestDriver(t, d)
+	lfs := &blockingLfs{attaching: make(chan struct{}), proceed: make(chan struct{})}
+	d.lfs = lfs
+
+	if err := d.Create("base", "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	file := path.Join(d.dir(diffPath, "base"), "data")
+	if err := ioutil.WriteFile(file, []byte("hot data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateReadWrite("c1", "base", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get("c1", ""); err != nil {
+		t.Fatal(err)
+	}
+	<-lfs.attaching
+
+	if err := d.Put("c1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"c1", "base"} {
+		if err := d.Remove(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The collector stays away from the dirs of base until the attach
+	// detached them
+	if err := d.CollectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	removing := removingDirs(t, d)
+	if len(removing) != 1 || !strings.HasPrefix(removing[0], "base-") {
+		t.Fatalf("Expected the dirs of base to be kept, found %v", removing)
+	}
+
+	close(lfs.proceed)
+	d.pcc.wg.Wait()
+	expected := [][]string{
+		{"pcc", "attach", "-i", "1", file},
+		{"pcc", "detach", path.Join(d.dir(diffPath, removing[0]), "data")},
+	}
+	if !reflect.DeepEqual(lfs.commands, expected) {
+		t.Fatalf("Expected lfs commands %v, got %v", expected, lfs.commands)
+	}
+	if err := d.CollectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	if removing := removingDirs(t, d); len(removing) != 0 {
+		t.Fatalf("Expected the dirs of base to be deleted once detached, found %v", removing)
+	}
+}
+
+func TestLustreClientMount(t *testing.T) {
+	fs, err := ioutil.TempDir("/var/tmp", "lustre-fs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(fs)
+	defer func(m func() clientMounter) { newClientMounter = m }(newClientMounter)
+	newClientMounter = func() clientMounter { return bindMounter{dir: fs} }
+
+	d, _ := newTestDriver(t, "lustre.mgs_nid=10.0.0.1@tcp", "lustre.fsname=testfs", "lustre.fileset=/docker/")
+	if d.client.source != "10.0.0.1@tcp:/testfs/docker" || !d.client.owned {
+		t.Fatalf("Expected the driver to mount 10.0.0.1@tcp:/testfs/docker, got %s", d.client)
+	}
+	if _, err := os.Stat(path.Join(fs, layersPath)); err != nil {
+		t.Fatalf("Expected the driver root on the mounted filesystem: %v", err)
+	}
+
+	// A lost mount is mounted again
+	if err := syscall.Unmount(d.root, syscall.MNT_DETACH); err != nil {
+		t.Fatal(err)
+	}
+	d.checkClientMount()
+	if _, err := os.Stat(path.Join(d.root, layersPath)); err != nil {
+		t.Fatalf("Expected the filesystem to be remounted: %v", err)
+	}
+
+	// So is a mount whose statfs hangs
+	d.client.probe = &runningOp{op: "statfs", path: d.root, done: make(chan struct{})}
+	d.checkClientMount()
+	if d.client.probe != nil {
+		t.Fatal("Expected the remount to forget the statfs of the old mount")
+	}
+	if _, err := os.Stat(path.Join(d.root, layersPath)); err != nil {
+		t.Fatalf("Expected the filesystem to be remounted: %v", err)
+	}
+
+	// Docker's Cleanup leaves the client mount to the plugin
+	if err := d.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := mountInfo(d.root); err != nil || m == nil {
+		t.Fatalf("Expected Cleanup to leave %s mounted, got %v, %v", d.root, m, err)
+	}
+
+	root := d.root
+	cleanupTestDriver(t, d)
+	if m, err := mountInfo(root); err != nil || m != nil {
+		t.Fatalf("Expected Shutdown to unmount %s, got %v, %v", root, m, err)
+	}
+}
+
+func TestLustreCleanup(t *testing.T) {
+	d, _ := newTestDriver(t)
+	defer cleanupTestDriver(t, d)
+
+	if err := d.Create("base", "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Create("top", "base", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get("top", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if mounted, err := mountpk.Mounted(d.dir(mntPath, "top")); err != nil || mounted {
+		t.Fatalf("Expected Cleanup to unmount top, got %t, %v", mounted, err)
+	}
+	if len(d.active) != 0 {
+		t.Fatalf("Expected no active mounts after Cleanup, got %d", len(d.active))
+	}
+
+	// The driver keeps working for the next daemon
+	if _, err := d.Get("top", ""); err != nil {
+		t.Fatal(err)
+	}
+	if mounted, err := mountpk.Mounted(d.dir(mntPath, "top")); err != nil || !mounted {
+		t.Fatalf("Expected top to be mounted again, got %t, %v", mounted, err)
+	}
+	if err := d.Put("top"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Remove("top"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CollectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLustreOffline(t *testing.T) {
+	fs, err := ioutil.TempDir("/var/tmp", "lustre-fs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(fs)
+	defer func(m func() clientMounter) { newClientMounter = m }(newClientMounter)
+	newClientMounter = func() clientMounter { return bindMounter{dir: fs} }
+
+	d, _ := newTestDriver(t, "lustre.offline=true", "lustre.mgs_nid=10.0.0.1@tcp", "lustre.fsname=testfs")
+	root := d.root
+	defer os.RemoveAll(root)
+	if err := d.Create("base", "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Create("top", "base", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get("top", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Like after the mount command, the layer stays mounted on the client
+	// mount, and shutting down twice is fine
+	for i := 0; i < 2; i++ {
+		if err := d.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m, err := mountInfo(root); err != nil || m == nil {
+		t.Fatalf("Expected the client mount to be left alone, got %v, %v", m, err)
+	}
+	if mounted, err := mountpk.Mounted(d.dir(mntPath, "top")); err != nil || !mounted {
+		t.Fatalf("Expected top to stay mounted, got %t, %v", mounted, err)
+	}
+
+	if err := d.unmount("top"); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Unmount(root, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLustreHealthFailFast(t *testing.T) {
+	d, lfs := newTestDriver(t, "lustre.health_interval=1h")
+	defer cleanupTestDriver(t, d)
+	d.health.lustre = true
+
+	lfs.output = "fs-MDT0000-mdc-ffff8800: active\nfs-OST0000-osc-ffff8800: check error: Resource temporarily unavailable\n"
+	d.checkHealth()
+	err := d.Create("down", "", "", nil)
+	if _, ok := err.(*ErrUnhealthy); !ok {
+		t.Fatalf("Expected Create to fail with ErrUnhealthy, got %v", err)
+	}
+	if health := d.Health(); health.Healthy || len(health.Problems) != 1 || !strings.Contains(health.Problems[0], "OST0000") {
+		t.Fatalf("Expected OST0000 to be reported, got %+v", health)
+	}
+
+	lfs.output = "fs-MDT0000-mdc-ffff8800: active\nfs-OST0000-osc-ffff8800: active\n"
+	d.checkHealth()
+	if err := d.Create("up", "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLustreContextTimeout(t *testing.T) {
+	d, _ := newTestDriver(t)
+	defer cleanupTestDriver(t, d)
+
+	if err := d.Create("base", "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Create("top", "base", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := d.GetContext(ctx, "top", ""); err != context.Canceled {
+		t.Fatalf("Expected Get with a canceled context to fail with %v, got %v", context.Canceled, err)
+	}
+	if _, err := d.Get("top", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put("top"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A mount that was given up on is waited for, not repeated
+	release := make(chan struct{})
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	mnt := d.dir(mntPath, "top")
+	r, err := startFsOp(ctx, "mount", mnt, func() error {
+		<-release
+		return d.mountID("top", "")
+	})
+	if r == nil || !plugindriver.IsTimeout(err) {
+		t.Fatalf("Expected the mount to be left running with a timeout error, got %v", err)
+	}
+	d.Lock()
+	d.active["top"] = &ActiveMount{path: mnt, pending: r}
+	d.Unlock()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := d.GetContext(ctx, "top", ""); !plugindriver.IsTimeout(err) {
+		t.Fatalf("Expected Get to time out waiting for the mount, got %v", err)
+	}
+	close(release)
+	if _, err := d.Get("top", ""); err != nil {
+		t.Fatal(err)
+	}
+	mounts, err := mountpk.GetMounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, m := range mounts {
+		if m.Mountpoint == mnt {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Fatalf("Expected top to be mounted once, got %d mounts", count)
+	}
+	if err := d.Put("top"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A hung operation is given up on at the deadline
+	hang := make(chan struct{})
+	defer close(hang)
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = fsOp(ctx, "mount", "/hung", func() error {
+		<-hang
+		return nil
+	})
+	if !plugindriver.IsTimeout(err) {
+		t.Fatalf("Expected a timeout error, got %v", err)
+	}
+}
+
+func TestLustreImmutableLayers(t *testing.T) {
+	d, _ := newTestDriver(t, "lustre.immutable_layers=true")
+	defer cleanupTestDriver(t, d)
+
+	if err := d.Create("base", "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	file := path.Join(d.dir(diffPath, "base"), "data")
+	if err := ioutil.WriteFile(file, []byte("committed data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Creating a child commits the parent
+	if err := d.Create("top", "base", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	d.commits.Wait()
+	metadata, err := d.GetMetadata("base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata["digest"] == "" {
+		t.Fatalf("Expected base to be committed, got %v", metadata)
+	}
+	fi, err := os.Stat(d.dir(diffPath, "base"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm()&0222 != 0 {
+		t.Fatalf("Expected the diff dir of base to be read-only, got %s", fi.Mode())
+	}
+	if metadata["immutable"] == "true" {
+		if err := ioutil.WriteFile(file, []byte("modified"), 0644); err == nil {
+			t.Fatal("Expected writing to an immutable layer to fail")
+		}
+		if err := setImmutable(file, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ioutil.WriteFile(file, []byte("modified"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := d.Check(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].Kind != problemModifiedLayer || problems[0].ID != "base" {
+		t.Fatalf("Expected base to be reported as modified, got %+v", problems)
+	}
+
+	for _, id := range []string{"top", "base"} {
+		if err := d.Remove(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.CollectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkProblems runs Check and returns whether each problem it reported
+// was repaired, by kind and id.
+func checkProblems(t *testing.T, d *LustreDriver, repair bool) map[string]bool {
+	problems, err := d.Check(repair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(map[string]bool)
+	for _, p := range problems {
+		out[p.Kind+" "+p.ID] = p.Repaired
+	}
+	if len(out) != len(problems) {
+		t.Fatalf("Expected every problem to be reported once, got %+v", problems)
+	}
+	return out
+}
+
+func TestLustreCheck(t *testing.T) {
+	d, _ := newTestDriver(t)
+	defer cleanupTestDriver(t, d)
+
+	for _, l := range [][2]string{{"base", ""}, {"top", "base"}, {"lost", ""}, {"old", ""}} {
+		if err := d.Create(l[0], l[1], "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(path.Join(d.dir(diffPath, "base"), "data"), []byte("base"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Leave the dirs of a removed layer to the collector
+	d.gc.collecting.Lock()
+	defer d.gc.collecting.Unlock()
+	if err := d.Remove("old"); err != nil {
+		t.Fatal(err)
+	}
+	// A dir without a layers file, a layer whose parent is gone, a
+	// missing work dir and an intermediate mount dir of a layer that
+	// isn't mounted
+	if err := os.Mkdir(d.dir(diffPath, "orphan"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(d.dir(layersPath, "lost"), []byte("gone\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(d.dir(workPath, "top")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(d.formatIntermediateMountPath("base", 1), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// A mount no Get holds, like one left by a crashed plugin
+	if _, err := d.Get("base", ""); err != nil {
+		t.Fatal(err)
+	}
+	d.Lock()
+	delete(d.active, "base")
+	d.Unlock()
+
+	expected := map[string]bool{
+		problemOrphanDir + " orphan":       false,
+		problemMissingParent + " lost":     false,
+		problemMissingDir + " top":         false,
+		problemStaleIntermediate + " base": false,
+		problemLeftoverMount + " base":     false,
+	}
+	if problems := checkProblems(t, d, false); !reflect.DeepEqual(problems, expected) {
+		t.Fatalf("Expected problems %v, got %v", expected, problems)
+	}
+	// Reporting changes nothing
+	if _, err := os.Lstat(d.dir(diffPath, "orphan")); err != nil {
+		t.Fatal(err)
+	}
+	if mounted, _ := mountpk.Mounted(d.dir(mntPath, "base")); !mounted {
+		t.Fatal("Expected base to stay mounted without repair")
+	}
+
+	// Only missing parents can't be repaired
+	for problem := range expected {
+		expected[problem] = problem != problemMissingParent+" lost"
+	}
+	if problems := checkProblems(t, d, true); !reflect.DeepEqual(problems, expected) {
+		t.Fatalf("Expected problems %v, got %v", expected, problems)
+	}
+	if _, err := os.Lstat(d.dir(diffPath, "orphan")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the orphan dir to be removed: %v", err)
+	}
+	if _, err := os.Lstat(d.dir(workPath, "top")); err != nil {
+		t.Fatalf("Expected the work dir of top to be recreated: %v", err)
+	}
+	if _, err := os.Lstat(d.formatIntermediateMountPath("base", 1)); !os.IsNotExist(err) {
+		t.Fatalf("Expected the intermediate mount dir to be removed: %v", err)
+	}
+	if mounted, _ := mountpk.Mounted(d.dir(mntPath, "base")); mounted {
+		t.Fatal("Expected the leftover mount of base to be unmounted")
+	}
+
+	// Nothing it didn't report is touched
+	if data, err := ioutil.ReadFile(path.Join(d.dir(diffPath, "base"), "data")); err != nil || string(data) != "base" {
+		t.Fatalf("Expected the data of base to be left alone, got %q %v", data, err)
+	}
+	for _, id := range []string{"base", "top", "lost"} {
+		if !d.Exists(id) {
+			t.Fatalf("Expected %s to be left alone", id)
+		}
+	}
+	if removing := removingDirs(t, d); len(removing) != 1 {
+		t.Fatalf("Expected the dirs of old to be left to the collector, found %v", removing)
+	}
+
+	expected = map[string]bool{problemMissingParent + " lost": false}
+	if problems := checkProblems(t, d, false); !reflect.DeepEqual(problems, expected) {
+		t.Fatalf("Expected only the missing parent to be left, got %v", problems)
+	}
+}
+
+func TestLustreCreateRollback(t *testing.T) {
+	d, _ := newTestDriver(t)
+	defer cleanupTestDriver(t, d)
+
+	if err := d.Create("child", "missing", "", nil); err == nil {
+		t.Fatal("Expected creating a layer on a missing parent to fail")
+	}
+	if err := d.Create("base", "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Create("base", "", "", nil); err == nil {
+		t.Fatal("Expected creating an existing layer to fail")
+	}
+
+	// Writing the meta file of child fails
+	if err := os.Mkdir(d.dir(metaPath, "child"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Create("child", "base", "", nil); err == nil {
+		t.Fatal("Expected the create to fail")
+	}
+	if d.Exists("child") {
+		t.Fatal("Expected a failed create to be rolled back")
+	}
+	for _, p := range allDirPaths {
+		if _, err := os.Lstat(d.dir(p, "child")); !os.IsNotExist(err) {
+			t.Fatalf("Expected %s to be removed: %v", d.dir(p, "child"), err)
+		}
+	}
+	// and not to keep its parent
+	if err := d.Remove("base"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLustreRemoveInUse(t *testing.T) {
+	d, _ := newTestDriver(t)
+	defer cleanupTestDriver(t, d)
+
+	if err := d.Create("base", "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Create("top", "base", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get("top", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []ErrLayerInUse{
+		{ID: "base", Children: []string{"top"}},
+		{ID: "top", References: 1},
+	} {
+		err := d.Remove(expected.ID)
+		inUse, ok := err.(*ErrLayerInUse)
+		if !ok || !reflect.DeepEqual(*inUse, expected) {
+			t.Fatalf("Expected %+v removing %s, got %v", expected, expected.ID, err)
+		}
+	}
+
+	// Forced, a mounted layer is unmounted, but a parent is still refused
+	if _, ok := d.ForceRemove("base").(*ErrLayerInUse); !ok {
+		t.Fatal("Expected force removing a parent to be refused")
+	}
+	if err := d.ForceRemove("top"); err != nil {
+		t.Fatal(err)
+	}
+	if d.Exists("top") {
+		t.Fatal("Expected top to be removed")
+	}
+	if err := d.Remove("base"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLustreCheckBackingFs(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Checking trusted xattrs needs root")
+	}
+	dir, err := ioutil.TempDir("/var/tmp", "lustre-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dType, err := supportsDType(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dType {
+		t.Skipf("%s doesn't return d_type", dir)
+	}
+	if err := checkBackingFs(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkWhiteout(dir); err != nil {
+		t.Fatal(err)
+	}
+	if !isWhiteout(path.Join(dir, "whiteout-src")) || isWhiteout(path.Join(dir, "whiteout-dst")) {
+		t.Fatal("Expected a whiteout in place of the renamed file only")
+	}
+}
+
+func TestLustreProbeOverlay(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Mounting overlay needs root")
+	}
+	dir, err := ioutil.TempDir("/var/tmp", "lustre-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	features, err := probeOverlay(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !features.multiLower {
+		t.Skip("overlay doesn't support multiple lower dirs")
+	}
+	if !features.whiteout {
+		t.Fatal("Expected overlay to leave a whiteout for a removed lower file")
+	}
+	// The probe cleans up after itself
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 0 {
+		t.Fatalf("Expected the probe to leave nothing behind, got %d entries", len(fis))
+	}
+}
+
+func TestLustreGCResume(t *testing.T) {
+	d, _ := newTestDriver(t)
+	root := d.root
+	if err := d.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A removal interrupted after the tombstone was written, and a new
+	// layer with the same id
+	if err := d.Create("a", "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	name := removalName("a")
+	for _, p := range allDirPaths {
+		if err := os.Rename(d.dir(p, "a"), d.dir(p, name+removingSuffix)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.gc.AddTombstone(name, "a", 42); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.createDirsFor("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	driver, err := Init(root, nil, nil, nil)
+	if err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+	d = driver.(*LustreDriver)
+	defer cleanupTestDriver(t, d)
+	if err := d.CollectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range allDirPaths {
+		if _, err := os.Lstat(d.dir(p, name+removingSuffix)); !os.IsNotExist(err) {
+			t.Fatalf("Expected %s to be deleted: %v", d.dir(p, name+removingSuffix), err)
+		}
+	}
+	if _, err := os.Lstat(path.Join(root, removingPath, name)); !os.IsNotExist(err) {
+		t.Fatalf("Expected tombstone to be deleted: %v", err)
+	}
+	if !d.Exists("a") {
+		t.Fatal("Expected the new layer a to be left alone")
+	}
+	if _, err := os.Lstat(d.dir(diffPath, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if pending := d.gc.PendingBytes(); pending != 0 {
+		t.Fatalf("Expected no pending bytes, got %d", pending)
+	}
+}
+
+func TestLustreGCRate(t *testing.T) {
+	d, _ := newTestDriver(t, "lustre.gc_rate=20")
+	defer cleanupTestDriver(t, d)
+
+	if err := d.Create("a", "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := ioutil.WriteFile(path.Join(d.dir(diffPath, "a"), fmt.Sprintf("file%d", i)), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 10 files and at least 3 dirs at 20 unlinks per second
+	start := time.Now()
+	if err := d.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CollectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Fatalf("Expected deletion to be rate limited, took %s", elapsed)
+	}
+	if removing := removingDirs(t, d); len(removing) != 0 {
+		t.Fatalf("Expected the diff of a to be deleted, found %v", removing)
+	}
+}
+
+// removingDirs returns the "-removing" dirs left in the diff dir of d.
+func removingDirs(t *testing.T, d *LustreDriver) []string {
+	fis, err := ioutil.ReadDir(path.Join(d.root, diffPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := []string{}
+	for _, fi := range fis {
+		if strings.HasSuffix(fi.Name(), removingSuffix) {
+			out = append(out, fi.Name())
+		}
+	}
+	return out
+}
+
+func TestLustreRemoveTwice(t *testing.T) {
+	d, _ := newTestDriver(t)
+	defer cleanupTestDriver(t, d)
+	// Keep the collector from running until the end
+	d.gc.collecting.Lock()
+
+	// Create and remove a twice before the collector gets to it
+	for i := 0; i < 2; i++ {
+		if err := d.Create("a", "", "", nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Remove("a"); err != nil {
+			t.Fatalf("Removing a the %d. time: %v", i+1, err)
+		}
+	}
+	if removing := removingDirs(t, d); len(removing) != 2 {
+		t.Fatalf("Expected the dirs of both removals, found %v", removing)
+	}
+
+	// The tombstones don't hide a live layer with the same id
+	if err := d.Create("a", "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Create("b", "a", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	layers, err := d.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 2 {
+		t.Fatalf("Expected a and b to be listed, got %+v", layers)
+	}
+	if err := d.Remove("a"); err == nil {
+		t.Fatal("Expected removing a to be refused while b is built on it")
+	}
+	problems, err := d.Check(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("Expected no problems, got %+v", problems)
+	}
+
+	d.gc.collecting.Unlock()
+	if err := d.CollectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	if removing := removingDirs(t, d); len(removing) != 0 {
+		t.Fatalf("Expected the removed dirs to be deleted, found %v", removing)
+	}
+	if !d.Exists("a") || !d.Exists("b") {
+		t.Fatal("Expected a and b to be left alone")
+	}
 }
 
 func TestLustreTeardown(t *testing.T) {
 	graphtest.PutDriver(t)
 }
+
+// fakeLfs records lfs commands instead of running them, and returns output
+// as their output.
+type fakeLfs struct {
+	sync.Mutex
+	commands [][]string
+	output   string
+}
+
+func (f *fakeLfs) Run(args ...string) (string, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.commands = append(f.commands, args)
+	return f.output, nil
+}
+
+// newTestDriver creates a driver with options in a temporary root that runs
+// lfs commands on a fakeLfs.
+func newTestDriver(t *testing.T, options ...string) (*LustreDriver, *fakeLfs) {
+	root, err := ioutil.TempDir("/var/tmp", "lustre-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestDriverWithMaps(t, root, nil, nil, options...)
+}
+
+// newRemappedTestDriver creates a driver like newTestDriver that maps
+// container root to remappedUID and remappedGID. The driver root is a
+// subdir of the returned temporary root.
+func newRemappedTestDriver(t *testing.T, options ...string) (*LustreDriver, string) {
+	root, err := ioutil.TempDir("/var/tmp", "lustre-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uidMaps := []idtools.IDMap{{ContainerID: 0, HostID: remappedUID, Size: 65536}}
+	gidMaps := []idtools.IDMap{{ContainerID: 0, HostID: remappedGID, Size: 65536}}
+	d, _ := newTestDriverWithMaps(t, root, uidMaps, gidMaps, options...)
+	return d, root
+}
+
+func newTestDriverWithMaps(t *testing.T, root string, uidMaps, gidMaps []idtools.IDMap, options ...string) (*LustreDriver, *fakeLfs) {
+	d, err := Init(root, options, uidMaps, gidMaps)
+	if err != nil {
+		os.RemoveAll(root)
+		if err == graphdriver.ErrNotSupported || err == graphdriver.ErrPrerequisites || err == graphdriver.ErrIncompatibleFS {
+			t.Skipf("Driver not supported: %v", err)
+		}
+		t.Fatal(err)
+	}
+	lfs := &fakeLfs{}
+	d.(*LustreDriver).lfs = lfs
+	return d.(*LustreDriver), lfs
+}
+
+func cleanupTestDriver(t *testing.T, d *LustreDriver) {
+	if err := d.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(d.root)
+}
+
+func verifyOwner(t *testing.T, p string, uid, gid uint32) {
+	fi, err := os.Lstat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := fi.Sys().(*syscall.Stat_t)
+	if stat.Uid != uid || stat.Gid != gid {
+		t.Fatalf("Expected %s to be owned by %d:%d, got %d:%d", p, uid, gid, stat.Uid, stat.Gid)
+	}
+}
+
+// bindMounter is a clientMounter that bind mounts dir instead of a Lustre
+// filesystem.
+type bindMounter struct {
+	dir string
+}
+
+func (b bindMounter) Mount(source, target, options string) error {
+	return syscall.Mount(b.dir, target, "", syscall.MS_BIND, "")
+}
+
+func (b bindMounter) Unmount(target string, flags int) error {
+	return syscall.Unmount(target, flags)
+}
+
+func (b bindMounter) Matches(m *mountpk.Info, source string) bool {
+	// The root of a bind mount is the path of dir in its filesystem
+	return strings.HasSuffix(b.dir, m.Root)
+}
+
+// stubCopytool is an hsmBackend that archives files at once and restores
+// them a poll after the restore was requested.
+type stubCopytool struct {
+	sync.Mutex
+	archived  map[string]bool
+	released  map[string]bool
+	restoring map[string]bool
+	restores  []string
+}
+
+func newStubCopytool() *stubCopytool {
+	return &stubCopytool{
+		archived:  make(map[string]bool),
+		released:  make(map[string]bool),
+		restoring: make(map[string]bool),
+	}
+}
+
+func (c *stubCopytool) Archive(files []string) error {
+	c.Lock()
+	defer c.Unlock()
+	for _, f := range files {
+		c.archived[f] = true
+	}
+	return nil
+}
+
+func (c *stubCopytool) Release(files []string) error {
+	c.Lock()
+	defer c.Unlock()
+	for _, f := range files {
+		if !c.archived[f] {
+			return fmt.Errorf("%s is not archived", f)
+		}
+		c.released[f] = true
+	}
+	return nil
+}
+
+func (c *stubCopytool) Restore(files []string) error {
+	c.Lock()
+	defer c.Unlock()
+	for _, f := range files {
+		c.restoring[f] = true
+		c.restores = append(c.restores, f)
+	}
+	return nil
+}
+
+func (c *stubCopytool) State(file string) (hsmFileState, error) {
+	c.Lock()
+	defer c.Unlock()
+	s := hsmFileState{Archived: c.archived[file], Released: c.released[file]}
+	if c.restoring[file] {
+		delete(c.restoring, file)
+		delete(c.released, file)
+	}
+	return s, nil
+}
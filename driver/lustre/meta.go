@@ -0,0 +1,100 @@
+// +build linux
+
+package lustre
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// metaPath holds the driver state of every layer that isn't part of the
+// layers file, one JSON file per layer
+const metaPath = "meta"
+
+// layerMeta is the driver state of a layer.
+type layerMeta struct {
+	// Layout are the lfs setstripe arguments applied to the diff dir
+	Layout []string `json:",omitempty"`
+	// WorkLayout are the lfs setstripe arguments applied to the work dir
+	WorkLayout []string `json:",omitempty"`
+	// LastUsed is when the layer was last created, mounted or mounted as
+	// the parent of another layer
+	LastUsed time.Time
+	// HSMState tells whether the layer is archived and released
+	HSMState string `json:",omitempty"`
+	// ReadWrite is set for container layers
+	ReadWrite bool `json:",omitempty"`
+	// Size of the diff when it was applied
+	Size int64 `json:",omitempty"`
+	// PCCAttached is set once the files of the layer are attached to PCC
+	PCCAttached bool `json:",omitempty"`
+	// Digest of the content of the diff when the layer was committed
+	Digest string `json:",omitempty"`
+	// Immutable is set when the diff got the immutable attribute on commit
+	Immutable bool `json:",omitempty"`
+}
+
+// lastUsedResolution limits how often LastUsed is written for a layer
+const lastUsedResolution = time.Minute
+
+// loadMeta returns the state of id, which is empty if none was saved.
+func (d *LustreDriver) loadMeta(id string) (*layerMeta, error) {
+	m := &layerMeta{}
+	b, err := ioutil.ReadFile(d.dir(metaPath, id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// saveMeta replaces the state of id atomically.
+func (d *LustreDriver) saveMeta(id string, m *layerMeta) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := d.dir(metaPath, id+".tmp")
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.dir(metaPath, id))
+}
+
+// updateMeta loads the state of id, applies fn to it and saves it again.
+func (d *LustreDriver) updateMeta(id string, fn func(m *layerMeta)) error {
+	d.metaLock.Lock()
+	defer d.metaLock.Unlock()
+
+	m, err := d.loadMeta(id)
+	if err != nil {
+		return err
+	}
+	fn(m)
+	return d.saveMeta(id, m)
+}
+
+// touchLayers records that ids are being used now.
+func (d *LustreDriver) touchLayers(ids []string) error {
+	now := time.Now()
+	for _, id := range ids {
+		m, err := d.loadMeta(id)
+		if err != nil {
+			return err
+		}
+		if now.Sub(m.LastUsed) < lastUsedResolution {
+			continue
+		}
+		if err := d.updateMeta(id, func(m *layerMeta) { m.LastUsed = now }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+// +build linux
+
+package lustre
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/parsers"
+	"github.com/docker/docker/pkg/units"
+)
+
+// lustreOptions holds the driver options given with --storage-opt.
+type lustreOptions struct {
+	idMappedMounts     bool
+	labelMountOption   string
+	gcInterval         time.Duration
+	gcRate             int
+	forceRemove        bool
+	offline            bool // Started by a command, without background work
+	dom                bool
+	domSize            int64
+	domRatio           float64
+	domMinFiles        int
+	pfl                []pflComponent
+	imagePool          string
+	containerPool      string
+	workPool           string
+	hsm                bool
+	hsmAge             time.Duration
+	hsmInterval        time.Duration
+	hsmArchiveID       int
+	hsmRestoreTimeout  time.Duration
+	capacity           *capacityTarget
+	evictInterval      time.Duration
+	pcc                bool
+	pccThreshold       int
+	pccArchiveID       int
+	mgsNID             string
+	fsName             string
+	fileset            string
+	mountOptions       string
+	mountCheckInterval time.Duration
+	healthInterval     time.Duration
+	healthTimeout      time.Duration
+	opTimeout          time.Duration
+	immutableLayers    bool
+}
+
+func parseOptions(options []string) (*lustreOptions, error) {
+	o := &lustreOptions{
+		labelMountOption:   "context",
+		gcInterval:         defaultGCInterval,
+		gcRate:             defaultGCRate,
+		domSize:            defaultDomSize,
+		domRatio:           defaultDomRatio,
+		domMinFiles:        defaultDomMinFiles,
+		hsmAge:             defaultHSMAge,
+		hsmInterval:        defaultHSMInterval,
+		hsmRestoreTimeout:  defaultHSMRestoreTimeout,
+		evictInterval:      defaultEvictInterval,
+		pccThreshold:       defaultPCCThreshold,
+		mountCheckInterval: defaultMountCheckInterval,
+		healthTimeout:      defaultHealthTimeout,
+	}
+	for _, option := range options {
+		key, val, err := parsers.ParseKeyValueOpt(option)
+		if err != nil {
+			return nil, err
+		}
+		key = strings.ToLower(key)
+		switch key {
+		case "lustre.idmapped_mounts":
+			o.idMappedMounts, err = strconv.ParseBool(val)
+			if err != nil {
+				return nil, err
+			}
+		case "lustre.label_mount_option":
+			switch val {
+			case "context", "fscontext":
+				o.labelMountOption = val
+			default:
+				return nil, fmt.Errorf("lustre: invalid label mount option %s, must be context or fscontext", val)
+			}
+		case "lustre.gc_interval":
+			o.gcInterval, err = time.ParseDuration(val)
+			if err != nil {
+				return nil, err
+			}
+			if o.gcInterval <= 0 {
+				return nil, fmt.Errorf("lustre: gc interval must be positive, got %s", val)
+			}
+		case "lustre.gc_rate":
+			o.gcRate, err = strconv.Atoi(val)
+			if err != nil {
+				return nil, err
+			}
+		case "lustre.force_remove":
+			o.forceRemove, err = strconv.ParseBool(val)
+			if err != nil {
+				return nil, err
+			}
+		case "lustre.offline":
+			o.offline, err = strconv.ParseBool(val)
+			if err != nil {
+				return nil, err
+			}
+		case "lustre.dom":
+			o.dom, err = strconv.ParseBool(val)
+			if err != nil {
+				return nil, err
+			}
+		case "lustre.dom_size":
+			o.domSize, err = units.RAMInBytes(val)
+			if err != nil {
+				return nil, err
+			}
+			if o.domSize <= 0 || o.domSize%domAlign != 0 {
+				return nil, fmt.Errorf("lustre: dom size must be a positive multiple of 64KiB, got %s", val)
+			}
+		case "lustre.dom_ratio":
+			o.domRatio, err = strconv.ParseFloat(val, 64)
+			if err != nil {
+				return nil, err
+			}
+			if o.domRatio <= 0 || o.domRatio > 1 {
+				return nil, fmt.Errorf("lustre: dom ratio must be in (0, 1], got %s", val)
+			}
+		case "lustre.dom_min_files":
+			o.domMinFiles, err = strconv.Atoi(val)
+			if err != nil {
+				return nil, err
+			}
+		case "lustre.pfl":
+			o.pfl, err = parsePFL(val)
+			if err != nil {
+				return nil, fmt.Errorf("lustre: invalid pfl template %s: %v", val, err)
+			}
+		case "lustre.image_pool", "lustre.container_pool", "lustre.work_pool":
+			if !poolNameRegexp.MatchString(val) {
+				return nil, fmt.Errorf("lustre: invalid pool name %s", val)
+			}
+			switch key {
+			case "lustre.image_pool":
+				o.imagePool = val
+			case "lustre.container_pool":
+				o.containerPool = val
+			default:
+				o.workPool = val
+			}
+		case "lustre.hsm":
+			o.hsm, err = strconv.ParseBool(val)
+			if err != nil {
+				return nil, err
+			}
+		case "lustre.hsm_age", "lustre.hsm_interval", "lustre.hsm_restore_timeout":
+			dur, err := time.ParseDuration(val)
+			if err != nil {
+				return nil, err
+			}
+			if dur <= 0 {
+				return nil, fmt.Errorf("lustre: %s must be positive, got %s", key, val)
+			}
+			switch key {
+			case "lustre.hsm_age":
+				o.hsmAge = dur
+			case "lustre.hsm_interval":
+				o.hsmInterval = dur
+			default:
+				o.hsmRestoreTimeout = dur
+			}
+		case "lustre.hsm_archive_id":
+			o.hsmArchiveID, err = strconv.Atoi(val)
+			if err != nil {
+				return nil, err
+			}
+		case "lustre.capacity":
+			o.capacity, err = parseCapacity(val)
+			if err != nil {
+				return nil, fmt.Errorf("lustre: invalid capacity %s: %v", val, err)
+			}
+		case "lustre.evict_interval":
+			o.evictInterval, err = time.ParseDuration(val)
+			if err != nil {
+				return nil, err
+			}
+			if o.evictInterval <= 0 {
+				return nil, fmt.Errorf("lustre: evict interval must be positive, got %s", val)
+			}
+		case "lustre.pcc":
+			o.pcc, err = strconv.ParseBool(val)
+			if err != nil {
+				return nil, err
+			}
+		case "lustre.pcc_threshold":
+			o.pccThreshold, err = strconv.Atoi(val)
+			if err != nil {
+				return nil, err
+			}
+			if o.pccThreshold < 1 {
+				return nil, fmt.Errorf("lustre: pcc threshold must be at least 1, got %s", val)
+			}
+		case "lustre.pcc_archive_id":
+			o.pccArchiveID, err = strconv.Atoi(val)
+			if err != nil {
+				return nil, err
+			}
+		case "lustre.mgs_nid":
+			if val == "" || strings.ContainsAny(val, "/ \t") {
+				return nil, fmt.Errorf("lustre: invalid MGS NID %s", val)
+			}
+			o.mgsNID = val
+		case "lustre.fsname":
+			if !fsNameRegexp.MatchString(val) {
+				return nil, fmt.Errorf("lustre: invalid filesystem name %s", val)
+			}
+			o.fsName = val
+		case "lustre.fileset":
+			o.fileset = strings.Trim(path.Clean("/"+val), "/")
+			if o.fileset == "" {
+				return nil, fmt.Errorf("lustre: invalid fileset %s", val)
+			}
+		case "lustre.mount_options":
+			if strings.ContainsAny(val, " \t") {
+				return nil, fmt.Errorf("lustre: invalid mount options %s", val)
+			}
+			o.mountOptions = val
+		case "lustre.mount_check_interval":
+			o.mountCheckInterval, err = time.ParseDuration(val)
+			if err != nil {
+				return nil, err
+			}
+			if o.mountCheckInterval <= 0 {
+				return nil, fmt.Errorf("lustre: mount check interval must be positive, got %s", val)
+			}
+		case "lustre.health_interval":
+			o.healthInterval, err = time.ParseDuration(val)
+			if err != nil {
+				return nil, err
+			}
+			if o.healthInterval < 0 {
+				return nil, fmt.Errorf("lustre: health interval can't be negative, got %s", val)
+			}
+		case "lustre.health_timeout":
+			o.healthTimeout, err = time.ParseDuration(val)
+			if err != nil {
+				return nil, err
+			}
+			if o.healthTimeout <= 0 {
+				return nil, fmt.Errorf("lustre: health timeout must be positive, got %s", val)
+			}
+		case "lustre.op_timeout":
+			o.opTimeout, err = time.ParseDuration(val)
+			if err != nil {
+				return nil, err
+			}
+			if o.opTimeout < 0 {
+				return nil, fmt.Errorf("lustre: op timeout can't be negative, got %s", val)
+			}
+		case "lustre.immutable_layers":
+			o.immutableLayers, err = strconv.ParseBool(val)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("lustre: unknown option %s", key)
+		}
+	}
+	if o.pcc && o.pccArchiveID <= 0 {
+		return nil, fmt.Errorf("lustre: lustre.pcc needs lustre.pcc_archive_id")
+	}
+	if (o.mgsNID == "") != (o.fsName == "") {
+		return nil, fmt.Errorf("lustre: lustre.mgs_nid and lustre.fsname must be set together")
+	}
+	if o.mgsNID == "" && (o.fileset != "" || o.mountOptions != "") {
+		return nil, fmt.Errorf("lustre: lustre.fileset and lustre.mount_options need lustre.mgs_nid")
+	}
+	return o, nil
+}
+
+// Reconfigure applies the options that can change while the driver is
+// running, the GC interval and rate. Changes to other options are ignored
+// until the driver is restarted.
+func (d *LustreDriver) Reconfigure(options []string) error {
+	opts, err := parseOptions(options)
+	if err != nil {
+		return err
+	}
+	d.gc.SetInterval(opts.gcInterval)
+	d.gc.SetRate(opts.gcRate)
+
+	d.Lock()
+	d.options.gcInterval = opts.gcInterval
+	d.options.gcRate = opts.gcRate
+	d.Unlock()
+	return nil
+}
@@ -0,0 +1,119 @@
+// +build linux
+
+package lustre
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const defaultPCCThreshold = 3
+
+// pccPolicy holds the PCC settings of the driver and the attaches that are
+// running.
+type pccPolicy struct {
+	threshold int // Mounts on top of a layer before it is attached
+	archiveID int // Archive ID of the PCC backend on this node
+
+	attaching map[string]*pccAttaching // Protected by the driver lock
+	wg        sync.WaitGroup
+}
+
+// pccAttaching is an attach that is running. A Remove of the layer
+// meanwhile leaves detaching the files and the tombstone to it.
+type pccAttaching struct {
+	removal string // Removal name of the layer, once it was removed
+	size    int64
+}
+
+// lowerRefs counts the mounts that use id as a lower dir.
+// The caller must hold the driver lock.
+func (d *LustreDriver) lowerRefs(id string) int {
+	refs := 0
+	for active, m := range d.active {
+		if m.referenceCount == 0 {
+			continue
+		}
+		parents, _ := d.getParentIds(active)
+		for _, parent := range parents {
+			if parent == id {
+				refs += m.referenceCount
+				break
+			}
+		}
+	}
+	return refs
+}
+
+// attachHotLayers attaches the layers among parents that are now the lower
+// dir of at least threshold mounts to PCC in the background. Attaching
+// copies the files to the local cache, which takes too long for Get.
+// The caller must hold the driver lock.
+func (d *LustreDriver) attachHotLayers(parents []string) {
+	p := d.pcc
+	for _, id := range parents {
+		if p.attaching[id] != nil || d.lowerRefs(id) < p.threshold {
+			continue
+		}
+		m, err := d.loadMeta(id)
+		if err != nil || m.PCCAttached {
+			continue
+		}
+		a := &pccAttaching{}
+		p.attaching[id] = a
+		p.wg.Add(1)
+		go func(id string) {
+			defer p.wg.Done()
+			if err := d.pccAttach(id, a); err != nil {
+				logrus.Warnf("lustre pcc: attaching %s failed: %v", id, err)
+			}
+			d.Lock()
+			delete(p.attaching, id)
+			removal := a.removal
+			d.Unlock()
+			// Removed while it was attached, some of the files may be
+			// attached even if the attach failed
+			if removal != "" {
+				d.pccDetach(id, removal)
+				d.finishRemove(removal, id, a.size)
+			}
+		}(id)
+	}
+}
+
+// pccAttach attaches the files of id to PCC and records it.
+func (d *LustreDriver) pccAttach(id string, a *pccAttaching) error {
+	files, err := d.layerFiles(id)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("lustre pcc: attaching %d files of %s", len(files), id)
+	if err := runBatched(d.lfs, []string{"pcc", "attach", "-i", strconv.Itoa(d.pcc.archiveID)}, files); err != nil {
+		return err
+	}
+	// Don't leave a meta file behind if the layer was removed meanwhile,
+	// or mark a layer created with the same id since, holding the lock so
+	// it can't be removed in between
+	d.Lock()
+	defer d.Unlock()
+	if a.removal != "" || !d.Exists(id) {
+		return nil
+	}
+	return d.updateMeta(id, func(m *layerMeta) { m.PCCAttached = true })
+}
+
+// pccDetach detaches the attached files of id from PCC once Remove moved
+// its dirs out of the way to the removal name, so removing or evicting the
+// layer frees the local cache too. The layer is removed either way, so
+// failures are only logged.
+func (d *LustreDriver) pccDetach(id, name string) {
+	files, err := d.layerFiles(name + removingSuffix)
+	if err == nil {
+		err = runBatched(d.lfs, []string{"pcc", "detach"}, files)
+	}
+	if err != nil {
+		logrus.Warnf("lustre pcc: detaching %s failed: %v", id, err)
+	}
+}
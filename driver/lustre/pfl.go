@@ -0,0 +1,88 @@
+// +build linux
+
+package lustre
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/pkg/units"
+)
+
+// poolNameRegexp matches valid OST pool names
+var poolNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,15}$`)
+
+// pflComponent is a component of a Progressive File Layout template.
+type pflComponent struct {
+	end   int64 // Extent end in bytes, -1 for the end of file
+	count int   // Stripe count, -1 for all OSTs, 0 for the filesystem default
+	pool  string
+}
+
+// parsePFL parses a PFL template of comma separated components
+// "end[:count[:pool]]", e.g. "4M:1,1G:4:flash,-1:-1:capacity". Extent ends
+// must grow and the last one must be -1, the end of file.
+func parsePFL(template string) ([]pflComponent, error) {
+	var components []pflComponent
+	var prev int64
+	specs := strings.Split(template, ",")
+	for i, spec := range specs {
+		fields := strings.Split(spec, ":")
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("component %q has more than end, count and pool", spec)
+		}
+
+		c := pflComponent{}
+		if fields[0] == "-1" || fields[0] == "eof" {
+			c.end = -1
+		} else {
+			end, err := units.RAMInBytes(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("component %q: invalid extent end: %v", spec, err)
+			}
+			if end%domAlign != 0 || end <= prev {
+				return nil, fmt.Errorf("component %q: extent end must be a multiple of 64KiB beyond the previous one", spec)
+			}
+			c.end, prev = end, end
+		}
+		if c.end == -1 && i != len(specs)-1 {
+			return nil, fmt.Errorf("component %q: only the last component can extend to the end of file", spec)
+		}
+
+		if len(fields) > 1 && fields[1] != "" {
+			count, err := strconv.Atoi(fields[1])
+			if err != nil || count < -1 {
+				return nil, fmt.Errorf("component %q: invalid stripe count %q", spec, fields[1])
+			}
+			c.count = count
+		}
+		if len(fields) > 2 {
+			if !poolNameRegexp.MatchString(fields[2]) {
+				return nil, fmt.Errorf("component %q: invalid pool name %q", spec, fields[2])
+			}
+			c.pool = fields[2]
+		}
+		components = append(components, c)
+	}
+	if components[len(components)-1].end != -1 {
+		return nil, fmt.Errorf("the last component must extend to the end of file (-1)")
+	}
+	return components, nil
+}
+
+// pflLayout returns the lfs setstripe arguments of a PFL template.
+func pflLayout(components []pflComponent) []string {
+	var args []string
+	for _, c := range components {
+		args = append(args, "-E", strconv.FormatInt(c.end, 10))
+		if c.count != 0 {
+			args = append(args, "-c", strconv.Itoa(c.count))
+		}
+		if c.pool != "" {
+			args = append(args, "-p", c.pool)
+		}
+	}
+	return args
+}
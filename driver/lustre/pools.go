@@ -0,0 +1,74 @@
+// +build linux
+
+package lustre
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Storage options of Create and CreateReadWrite, e.g.
+// docker run --storage-opt pool=flash
+const (
+	poolStorageOpt     = "pool"
+	workPoolStorageOpt = "work_pool"
+)
+
+// placement holds the OST pools of the dirs of a new layer, "" for the
+// filesystem default.
+type placement struct {
+	diffPool string
+	workPool string
+}
+
+// placementFor returns the pools of a new image layer, or of a container
+// layer if rw is set. Pools given in storageOpt win over the driver options.
+func (d *LustreDriver) placementFor(rw bool, storageOpt map[string]string) (placement, error) {
+	p := placement{diffPool: d.options.imagePool}
+	if rw {
+		p = placement{diffPool: d.options.containerPool, workPool: d.options.workPool}
+	}
+	for key, val := range storageOpt {
+		switch strings.ToLower(key) {
+		case poolStorageOpt:
+			p.diffPool = val
+		case workPoolStorageOpt:
+			p.workPool = val
+		default:
+			return p, fmt.Errorf("--storage-opt %s is not supported by lustre", key)
+		}
+		if !poolNameRegexp.MatchString(val) {
+			return p, fmt.Errorf("--storage-opt %s: invalid pool name %q", key, val)
+		}
+	}
+	return p, nil
+}
+
+// diffLayout returns the default layout of a diff dir in pool. Components
+// of the PFL template without a pool of their own are placed in pool.
+func (d *LustreDriver) diffLayout(pool string) []string {
+	if d.options.pfl != nil {
+		components := make([]pflComponent, len(d.options.pfl))
+		copy(components, d.options.pfl)
+		for i := range components {
+			if components[i].pool == "" {
+				components[i].pool = pool
+			}
+		}
+		return pflLayout(components)
+	}
+	if pool == "" {
+		return nil
+	}
+	return []string{"-p", pool}
+}
+
+// applyPlacement sets the default layouts of the dirs of a new layer.
+// Overlay copies files up through the work dir, so files a container
+// modifies are placed by the layout of its work dir.
+func (d *LustreDriver) applyPlacement(id string, p placement) {
+	d.applyLayout(id, diffPath, d.diffLayout(p.diffPool))
+	if p.workPool != "" {
+		d.applyLayout(id, workPath, []string{"-p", p.workPool})
+	}
+}
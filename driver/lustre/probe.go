@@ -0,0 +1,199 @@
+// +build linux
+
+package lustre
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"unsafe"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// overlayFeatures records what the kernel's overlay implementation and the
+// backing filesystem were found to support when the driver was initialized.
+type overlayFeatures struct {
+	multiLower bool
+	whiteout   bool
+}
+
+// probeOverlay creates a throwaway overlay in a temporary directory under root
+// and checks which features actually work. Enterprise HPC kernels backport
+// overlay features, so the kernel version alone can't be trusted.
+func probeOverlay(root string) (*overlayFeatures, error) {
+	td, err := ioutil.TempDir(root, "probe-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(td)
+
+	// d_type is required of the backing filesystem, see checkBackingFs
+	features := &overlayFeatures{}
+	lower1 := path.Join(td, "lower1")
+	lower2 := path.Join(td, "lower2")
+	upper := path.Join(td, "upper")
+	work := path.Join(td, "work")
+	merged := path.Join(td, "merged")
+	for _, dir := range []string{lower1, lower2, upper, work, merged} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	if err := ioutil.WriteFile(path.Join(lower2, "probe"), nil, 0644); err != nil {
+		return nil, err
+	}
+
+	opts := fmt.Sprintf("lowerdir=%s:%s,upperdir=%s,workdir=%s", lower1, lower2, upper, work)
+	if err := syscall.Mount("overlay", merged, "overlay", 0, opts); err != nil {
+		logrus.Debugf("overlay probe: mount with multiple lower dirs failed: %v", err)
+		return features, nil
+	}
+	defer func() {
+		if err := syscall.Unmount(merged, syscall.MNT_DETACH); err != nil {
+			logrus.Debugf("overlay probe: failed to unmount %s: %v", merged, err)
+		}
+	}()
+	features.multiLower = true
+
+	// Removing a lower file through the merged dir must leave a whiteout
+	// (a 0/0 character device) behind in the upper dir.
+	if err := os.Remove(path.Join(merged, "probe")); err != nil {
+		logrus.Debugf("overlay probe: failed to remove lower file: %v", err)
+		return features, nil
+	}
+	features.whiteout = isWhiteout(path.Join(upper, "probe"))
+
+	return features, nil
+}
+
+// checkBackingFs verifies that the filesystem under root provides what
+// overlay needs from an upper filesystem. On Lustre these depend on the
+// client and server configuration, and without them mountrw fails later
+// with errors that don't point at the cause.
+func checkBackingFs(root string) error {
+	td, err := ioutil.TempDir(root, "check-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(td)
+
+	dType, err := supportsDType(td)
+	if err != nil {
+		return fmt.Errorf("failed to check d_type support on %s: %v", root, err)
+	}
+	if !dType {
+		return fmt.Errorf("backing filesystem at %s does not return d_type from getdents; "+
+			"overlay requires d_type support, check that the Lustre client is recent enough", root)
+	}
+
+	if err := checkTrustedXattr(td); err != nil {
+		return fmt.Errorf("backing filesystem at %s does not support trusted.* xattrs (%v); "+
+			"mount the Lustre client with xattr support (e.g. -o user_xattr,acl) and run the plugin as root", root, err)
+	}
+
+	if err := checkWhiteout(td); err != nil {
+		return fmt.Errorf("backing filesystem at %s cannot create whiteouts with renameat2(RENAME_WHITEOUT) (%v); "+
+			"overlay needs this to delete lower files, check the Lustre client and kernel versions", root, err)
+	}
+	return nil
+}
+
+// checkTrustedXattr sets and reads back the kind of trusted.* xattr overlay
+// uses to mark opaque directories.
+func checkTrustedXattr(dir string) error {
+	p := path.Join(dir, "xattr")
+	if err := os.Mkdir(p, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Setxattr(p, "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+		return err
+	}
+	buf := make([]byte, 1)
+	n, err := syscall.Getxattr(p, "trusted.overlay.opaque", buf)
+	if err != nil {
+		return err
+	}
+	if n != 1 || buf[0] != 'y' {
+		return fmt.Errorf("read back %q", buf[:n])
+	}
+	return nil
+}
+
+// checkWhiteout renames a file with RENAME_WHITEOUT, which is how overlay
+// creates whiteouts in the upper dir, and checks one was left behind.
+func checkWhiteout(dir string) error {
+	src := path.Join(dir, "whiteout-src")
+	dst := path.Join(dir, "whiteout-dst")
+	if err := ioutil.WriteFile(src, nil, 0644); err != nil {
+		return err
+	}
+	if err := unix.Renameat2(unix.AT_FDCWD, src, unix.AT_FDCWD, dst, unix.RENAME_WHITEOUT); err != nil {
+		return err
+	}
+	if !isWhiteout(src) {
+		return fmt.Errorf("no whiteout found at %s", src)
+	}
+	return nil
+}
+
+// supportsDType creates a file in dir and reads it back with getdents to see
+// whether the filesystem fills in d_type. Overlay needs d_type to tell
+// whiteouts apart without an extra stat of every entry.
+func supportsDType(dir string) (bool, error) {
+	f, err := ioutil.TempFile(dir, "dtype-")
+	if err != nil {
+		return false, err
+	}
+	name := path.Base(f.Name())
+	f.Close()
+	defer os.Remove(f.Name())
+
+	fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return false, err
+	}
+	defer syscall.Close(fd)
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := syscall.Getdents(fd, buf)
+		if err != nil {
+			return false, err
+		}
+		if n <= 0 {
+			return false, fmt.Errorf("%s not found while reading %s", name, dir)
+		}
+		for off := 0; off < n; {
+			dirent := (*syscall.Dirent)(unsafe.Pointer(&buf[off]))
+			off += int(dirent.Reclen)
+			if direntName(dirent) == name {
+				return dirent.Type != syscall.DT_UNKNOWN, nil
+			}
+		}
+	}
+}
+
+func direntName(dirent *syscall.Dirent) string {
+	name := make([]byte, 0, len(dirent.Name))
+	for _, c := range dirent.Name {
+		if c == 0 {
+			break
+		}
+		name = append(name, byte(c))
+	}
+	return string(name)
+}
+
+// isWhiteout reports whether p is an overlay whiteout.
+func isWhiteout(p string) bool {
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return false
+	}
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && fi.Mode()&os.ModeCharDevice != 0 && stat.Rdev == 0
+}
@@ -0,0 +1,75 @@
+// +build linux
+
+package lustre
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ErrLayerInUse is returned when removing a layer that is still mounted or
+// that other layers are built on.
+type ErrLayerInUse struct {
+	ID         string
+	References int
+	Children   []string
+}
+
+func (e *ErrLayerInUse) Error() string {
+	if len(e.Children) > 0 {
+		return fmt.Sprintf("layer %s is in use: it is the parent of %s", e.ID, strings.Join(e.Children, ", "))
+	}
+	return fmt.Sprintf("layer %s is in use: it is mounted %d times", e.ID, e.References)
+}
+
+// loadChildren builds the reverse-dependency index from the layers files.
+// Remove deletes the layers file of a layer, so every id that has one is a
+// live layer.
+func (d *LustreDriver) loadChildren() error {
+	ids, err := loadIds(path.Join(d.root, layersPath))
+	if err != nil {
+		return err
+	}
+	d.children = make(map[string]map[string]struct{})
+	for _, id := range ids {
+		parents, err := d.getParentIds(id)
+		if err != nil {
+			return err
+		}
+		if len(parents) > 0 {
+			d.addChild(parents[0], id)
+		}
+	}
+	return nil
+}
+
+// addChild records that child was created on top of parent.
+// The caller must hold the driver lock.
+func (d *LustreDriver) addChild(parent, child string) {
+	if d.children[parent] == nil {
+		d.children[parent] = make(map[string]struct{})
+	}
+	d.children[parent][child] = struct{}{}
+}
+
+// removeChild forgets that child was created on top of parent.
+// The caller must hold the driver lock.
+func (d *LustreDriver) removeChild(parent, child string) {
+	delete(d.children[parent], child)
+	if len(d.children[parent]) == 0 {
+		delete(d.children, parent)
+	}
+}
+
+// getChildren returns the ids of the layers whose direct parent is id.
+// The caller must hold the driver lock.
+func (d *LustreDriver) getChildren(id string) []string {
+	out := []string{}
+	for child := range d.children[id] {
+		out = append(out, child)
+	}
+	sort.Strings(out)
+	return out
+}
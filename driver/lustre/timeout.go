@@ -0,0 +1,101 @@
+// +build linux
+
+package lustre
+
+import (
+	"context"
+
+	"github.com/Sirupsen/logrus"
+	plugindriver "github.com/bacaldwell/lustre-graph-driver/driver"
+)
+
+// withTimeout returns ctx with the deadline of the op timeout, unless it
+// already has an earlier one.
+func (d *LustreDriver) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d.options.opTimeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d.options.opTimeout)
+}
+
+// runningOp is a filesystem operation that was given up on but is still
+// running.
+type runningOp struct {
+	op, path string
+	done     chan struct{} // Closed once the operation returned
+	err      error         // Its result, set before done is closed
+}
+
+// fsOp runs fn, an operation on p that can block while Lustre servers are
+// unreachable, until ctx is done. An fn that hangs is left running, it
+// can't be interrupted; the caller gets ctxError instead of its result.
+func fsOp(ctx context.Context, op, p string, fn func() error) error {
+	_, err := startFsOp(ctx, op, p, fn)
+	return err
+}
+
+// startFsOp is fsOp, but when it gives up it also returns the operation
+// left running, so the caller can wait for it later.
+func startFsOp(ctx context.Context, op, p string, fn func() error) (*runningOp, error) {
+	if ctx.Err() != nil {
+		return nil, ctxError(ctx, op, p)
+	}
+	r := &runningOp{op: op, path: p, done: make(chan struct{})}
+	go func() {
+		r.err = fn()
+		close(r.done)
+	}()
+	select {
+	case <-r.done:
+		return nil, r.err
+	case <-ctx.Done():
+		logrus.Warnf("lustre: gave up waiting for %s of %s: %v", op, p, ctx.Err())
+		return r, ctxError(ctx, op, p)
+	}
+}
+
+// waitPending waits until a mount or unmount of id that was given up on
+// returns, and records whether the layer is mounted now. The caller must
+// hold the driver lock, it is released while waiting.
+func (d *LustreDriver) waitPending(ctx context.Context, id string) error {
+	for {
+		m := d.active[id]
+		if m == nil || m.pending == nil {
+			return nil
+		}
+		r := m.pending
+		d.Unlock()
+		select {
+		case <-r.done:
+		case <-ctx.Done():
+		}
+		d.Lock()
+		if m.pending != r {
+			// Someone else waited for it
+			continue
+		}
+		select {
+		case <-r.done:
+		default:
+			return ctxError(ctx, r.op, r.path)
+		}
+		m.pending = nil
+		if r.err != nil {
+			logrus.Warnf("lustre: %s of %s that was given up on failed: %v", r.op, r.path, r.err)
+		} else {
+			m.mounted = r.op == "mount"
+		}
+		if !m.mounted && m.referenceCount == 0 && d.active[id] == m {
+			delete(d.active, id)
+		}
+	}
+}
+
+// ctxError returns the error of an operation stopped because ctx is done,
+// a TimeoutError when its deadline passed.
+func ctxError(ctx context.Context, op, p string) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return &plugindriver.TimeoutError{Op: op, Path: p}
+	}
+	return ctx.Err()
+}
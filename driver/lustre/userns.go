@@ -0,0 +1,152 @@
+// +build linux
+
+package lustre
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/docker/docker/pkg/reexec"
+	"golang.org/x/sys/unix"
+)
+
+const usernsHoldCommand = "lustre-userns-hold"
+
+func init() {
+	reexec.Register(usernsHoldCommand, usernsHold)
+}
+
+// usernsHold keeps its user namespace alive until stdin is closed.
+func usernsHold() {
+	ioutil.ReadAll(os.Stdin)
+	os.Exit(0)
+}
+
+// remappedRoot creates and returns the subroot of root used for the given
+// mappings. Like the docker daemon, each mapping gets a subroot named
+// "<uid>.<gid>" after its remapped root, so layers extracted with different
+// ownership never mix.
+func remappedRoot(root string, uidMaps, gidMaps []idtools.IDMap) (string, error) {
+	rootUID, rootGID, err := idtools.GetRootUIDGID(uidMaps, gidMaps)
+	if err != nil {
+		return "", err
+	}
+	// The top level root only needs to be traversable by the remapped root
+	if err := idtools.MkdirAllAs(root, 0701, 0, 0); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	if err := os.Chmod(root, 0701); err != nil {
+		return "", err
+	}
+	root = path.Join(root, fmt.Sprintf("%d.%d", rootUID, rootGID))
+	if err := idtools.MkdirAllAs(root, 0700, rootUID, rootGID); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	return root, nil
+}
+
+// openUserns returns a file for a new user namespace with the given
+// mappings. It stays valid after the process that created it exits.
+func openUserns(uidMaps, gidMaps []idtools.IDMap) (*os.File, error) {
+	cmd := reexec.Command(usernsHoldCommand)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER,
+		UidMappings: toSysProcIDMap(uidMaps),
+		GidMappings: toSysProcIDMap(gidMaps),
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to create user namespace: %v", err)
+	}
+	defer func() {
+		stdin.Close()
+		cmd.Wait()
+	}()
+	return os.Open(fmt.Sprintf("/proc/%d/ns/user", cmd.Process.Pid))
+}
+
+func toSysProcIDMap(maps []idtools.IDMap) []syscall.SysProcIDMap {
+	out := make([]syscall.SysProcIDMap, len(maps))
+	for i, m := range maps {
+		out[i] = syscall.SysProcIDMap{ContainerID: m.ContainerID, HostID: m.HostID, Size: m.Size}
+	}
+	return out
+}
+
+// idmapMount clones the mount at source and attaches the clone at target
+// with file ownership shifted through the user namespace userns. Target may
+// be the same as source, in which case the clone is stacked on top.
+func idmapMount(source, target string, userns *os.File) error {
+	fd, err := unix.OpenTree(unix.AT_FDCWD, source, unix.OPEN_TREE_CLONE|unix.OPEN_TREE_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("error cloning mount %s: %v", source, err)
+	}
+	defer unix.Close(fd)
+
+	attr := &unix.MountAttr{
+		Attr_set:  unix.MOUNT_ATTR_IDMAP,
+		Userns_fd: uint64(userns.Fd()),
+	}
+	if err := unix.MountSetattr(fd, "", unix.AT_EMPTY_PATH, attr); err != nil {
+		return fmt.Errorf("error setting idmap on mount of %s: %v", source, err)
+	}
+	if err := unix.MoveMount(fd, "", unix.AT_FDCWD, target, unix.MOVE_MOUNT_F_EMPTY_PATH); err != nil {
+		return fmt.Errorf("error attaching idmapped mount to %s: %v", target, err)
+	}
+	return nil
+}
+
+// probeIDMappedMounts checks that an overlay on the backing filesystem can
+// be idmapped and returns the user namespace to use for the mappings.
+func probeIDMappedMounts(root string, uidMaps, gidMaps []idtools.IDMap) (_ *os.File, retErr error) {
+	if err := idtools.MkdirAllAs(root, 0700, 0, 0); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	td, err := ioutil.TempDir(root, "idmap-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(td)
+
+	lower := path.Join(td, "lower")
+	upper := path.Join(td, "upper")
+	work := path.Join(td, "work")
+	merged := path.Join(td, "merged")
+	for _, dir := range []string{lower, upper, work, merged} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work)
+	if err := syscall.Mount("overlay", merged, "overlay", 0, opts); err != nil {
+		return nil, fmt.Errorf("error creating overlay mount to %s: %v", merged, err)
+	}
+	defer syscall.Unmount(merged, syscall.MNT_DETACH)
+
+	userns, err := openUserns(uidMaps, gidMaps)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if retErr != nil {
+			userns.Close()
+		}
+	}()
+
+	if err := idmapMount(merged, merged, userns); err != nil {
+		return nil, err
+	}
+	if err := syscall.Unmount(merged, syscall.MNT_DETACH); err != nil {
+		logrus.Debugf("idmap probe: failed to unmount %s: %v", merged, err)
+	}
+	return userns, nil
+}
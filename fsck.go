@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/bacaldwell/lustre-graph-driver/driver"
+	flag "github.com/docker/docker/pkg/mflag"
+)
+
+// lockPath is the lock file in the driver root. serve holds it while it
+// serves the root and fsck takes it before checking, since every mount of
+// a running plugin looks like a leftover to fsck.
+const lockPath = "lock"
+
+// rootLock keeps the lock file open, and so locked, until we exit.
+var rootLock *os.File
+
+// lockRoot takes the lock file in dir without waiting for it.
+func lockRoot(dir string) error {
+	f, err := os.OpenFile(filepath.Join(dir, lockPath), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	switch err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err {
+	case nil:
+		rootLock = f
+		return nil
+	case syscall.EWOULDBLOCK:
+		f.Close()
+		return fmt.Errorf("%s is in use by a running plugin, stop it first", dir)
+	case syscall.ENOSYS, syscall.EOPNOTSUPP:
+		// Lustre clients mounted without -o flock or -o localflock
+		f.Close()
+		logrus.Warnf("Can't lock %s, fsck can't tell whether a plugin is using it: %v", dir, err)
+		return nil
+	default:
+		f.Close()
+		return err
+	}
+}
+
+// runFsck checks the driver root for inconsistencies and optionally
+// repairs them. It refuses to run while a plugin serves the same root.
+func runFsck(args []string) int {
+	cmd := flag.NewFlagSet("fsck", flag.ExitOnError)
+	flJSON := cmd.Bool([]string{"-json"}, false, "Print the problems found as JSON")
+	flRepair := cmd.Bool([]string{"-repair"}, false, "Repair the problems that can be repaired")
+	if !parseCommandFlags(cmd, args, 0, 0) {
+		return 1
+	}
+
+	return withDriver(func(driver graphdriver.Driver) error {
+		checker, ok := driver.(graphdriver.Checker)
+		if !ok {
+			return fmt.Errorf("Driver %s does not support fsck", driver)
+		}
+		if err := lockRoot(root); err != nil {
+			return err
+		}
+		problems, err := checker.Check(*flRepair)
+		if err != nil {
+			return fmt.Errorf("fsck failed: %v", err)
+		}
+
+		if *flJSON {
+			if err := json.NewEncoder(os.Stdout).Encode(problems); err != nil {
+				return err
+			}
+		} else {
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "KIND\tID\tPATH\tREPAIRED\tDETAIL")
+			for _, p := range problems {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\n", p.Kind, p.ID, p.Path, p.Repaired, p.Detail)
+			}
+			w.Flush()
+		}
+
+		unrepaired := 0
+		for _, p := range problems {
+			if !p.Repaired {
+				unrepaired++
+			}
+		}
+		if unrepaired > 0 {
+			return fmt.Errorf("%d problems not repaired", unrepaired)
+		}
+		return nil
+	})
+}
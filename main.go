@@ -1,25 +1,37 @@
-
 package main
 
 import (
 	"fmt"
-	"github.com/Sirupsen/logrus"
-	flag "github.com/docker/docker/pkg/mflag"
 	"github.com/bacaldwell/lustre-graph-driver/api"
 	"github.com/bacaldwell/lustre-graph-driver/driver"
+	"github.com/docker/docker/opts"
+	"github.com/docker/docker/pkg/idtools"
+	flag "github.com/docker/docker/pkg/mflag"
+	"github.com/docker/docker/pkg/reexec"
 	"os"
-)
-
-const (
-	socketAddress = "/run/docker/plugins/lustre.sock"
+	"time"
 )
 
 var (
-	root         string
-	graphDriver  string
-	graphOptions []string
-	flDebug      bool
-	flLogLevel   string
+	root            string
+	graphDriver     string
+	graphOptions    []string
+	flDebug         bool
+	flLogLevel      string
+	flUsernsRemap   string
+	flConfigFile    string
+	socketAddress   = "/run/docker/plugins/lustre.sock"
+	socketGroup     = "root"
+	specFormat      string
+	tcpAddress      string
+	tlsClientCert   string
+	tlsClientKey    string
+	tlsAuthzFile    string
+	shutdownTimeout time.Duration
+	managed         bool
+	loadedConfig    *Config
+	tlsConfig       api.TLSConfig
+	metricsAddress  string
 )
 
 func init() {
@@ -27,37 +39,95 @@ func init() {
 }
 
 func installFlags() {
+	flag.Usage = usage
 	flag.BoolVar(&flDebug, []string{"D", "-debug"}, false, "Enable debug mode")
 	flag.StringVar(&flLogLevel, []string{"l", "-log-level"}, "info", "Set the logging level")
 	flag.StringVar(&root, []string{"g", "-graph"}, "/var/lib/docker", "Path to use as the root of the graph driver")
 	flag.StringVar(&graphDriver, []string{"s", "-storage-driver"}, "", "Force the runtime to use a specific storage driver")
+	flag.StringVar(&flUsernsRemap, []string{"-userns-remap"}, "", "User/Group setting for user namespaces")
+	flag.Var(opts.NewListOptsRef(&graphOptions, nil), []string{"-storage-opt"}, "Set storage driver options")
+	flag.StringVar(&socketAddress, []string{"-socket"}, socketAddress, "Name of the plugin socket in /run/docker/plugins, or absolute path of the socket")
+	flag.StringVar(&socketGroup, []string{"G", "-group"}, socketGroup, "Group for the unix socket")
+	flag.StringVar(&specFormat, []string{"-plugin-spec"}, "", "Also write a plugin spec file for docker to find the socket, 'spec' or 'json'")
+	flag.StringVar(&tcpAddress, []string{"-tcp"}, "", "Listen on this TCP address instead of the unix socket")
+	flag.StringVar(&tlsConfig.CA, []string{"-tlscacert"}, "", "Trust certs signed only by this CA")
+	flag.StringVar(&tlsConfig.Certificate, []string{"-tlscert"}, "", "Path to TLS certificate file")
+	flag.StringVar(&tlsConfig.Key, []string{"-tlskey"}, "", "Path to TLS key file")
+	flag.BoolVar(&tlsConfig.Verify, []string{"-tlsverify"}, false, "Require and verify client certificates")
+	flag.StringVar(&tlsClientCert, []string{"-tls-client-cert"}, "", "Client certificate for docker, written to the .json spec")
+	flag.StringVar(&tlsClientKey, []string{"-tls-client-key"}, "", "Client key for docker, written to the .json spec")
+	flag.StringVar(&tlsAuthzFile, []string{"-tls-authz"}, "", "JSON file mapping client certificate subjects to allowed endpoints")
+	flag.DurationVar(&shutdownTimeout, []string{"-shutdown-timeout"}, defaultShutdownTimeout, "How long to wait for requests in flight when shutting down")
+	flag.BoolVar(&managed, []string{"-managed"}, false, "Run as a managed plugin, with the driver root and ID maps passed by docker")
+	flag.StringVar(&flConfigFile, []string{"-config-file"}, defaultConfigFile, "Configuration file of the plugin daemon")
 }
 
 func main() {
+	if reexec.Init() {
+		return
+	}
 
 	flag.Parse()
 
-	if flLogLevel != "" {
-		lvl, err := logrus.ParseLevel(flLogLevel)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Unable to parse logging level: %s\n", flLogLevel)
-			os.Exit(1)
-		}
-		logrus.SetLevel(lvl)
-	} else {
-		logrus.SetLevel(logrus.InfoLevel)
+	config, err := loadConfig(flConfigFile, isSet("-config-file"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
+	applyConfig(config)
+	loadedConfig = config
 
-	if flDebug {
-		logrus.SetLevel(logrus.DebugLevel)
+	if err := setLogLevel(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 
-	driver, err := graphdriver.New(root, graphOptions)
-	if err != nil {
-		logrus.Errorf("Create lustre driver failed: %v", err)
+	// Serve when no command is given, like before there were commands
+	name, args := "serve", []string{}
+	if flag.NArg() > 0 {
+		name, args = flag.Arg(0), flag.Args()[1:]
+	}
+	cmd := lookupCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", name)
+		usage()
 		os.Exit(1)
 	}
-	h := api.NewHandler(driver)
-	logrus.Infof("listening on %s\n", socketAddress)
-	fmt.Println(h.ServeUnix("root", socketAddress))
+	os.Exit(cmd.run(args))
+}
+
+// newDriver creates the graph driver from the command line flags. The
+// driver of a command is offline: it starts no background work and leaves
+// the client mount alone when it is cleaned up, that is up to the plugin.
+func newDriver(offline bool) (graphdriver.Driver, error) {
+	uidMaps, gidMaps, err := setupRemappedRoot(flUsernsRemap)
+	if err != nil {
+		return nil, err
+	}
+	options := graphOptions
+	if offline {
+		options = append(append([]string{}, graphOptions...), "lustre.offline=true")
+	}
+	graphdriver.DefaultDriver = graphDriver
+	return graphdriver.New(root, options, uidMaps, gidMaps)
+}
+
+// newManagedDriver creates the graph driver when docker initializes the
+// managed plugin. The root given with --graph wins over the one docker
+// passes, so the driver can keep its layers on a Lustre dir mounted into
+// the plugin, and --storage-opt options are applied after docker's.
+func newManagedDriver(home string, options []string, uidMaps, gidMaps []idtools.IDMap) (graphdriver.Driver, error) {
+	if isSet("g", "-graph") || loadedConfig.Graph != "" {
+		home = root
+	}
+	graphdriver.DefaultDriver = graphDriver
+	driver, err := graphdriver.New(home, append(options, graphOptions...), uidMaps, gidMaps)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockRoot(home); err != nil {
+		shutdownDriver(driver)
+		return nil, err
+	}
+	return driver, nil
 }
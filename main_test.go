@@ -0,0 +1,209 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bacaldwell/lustre-graph-driver/driver"
+	flag "github.com/docker/docker/pkg/mflag"
+)
+
+// parseFlags resets the flag variables to their defaults and parses args
+// like the command line.
+func parseFlags(t *testing.T, args ...string) {
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	graphOptions = nil
+	socketAddress = "/run/docker/plugins/lustre.sock"
+	socketGroup = "root"
+	installFlags()
+	if err := flag.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		config Config
+		valid  bool
+	}{
+		{"empty", Config{}, true},
+		{"socket", Config{Socket: "/run/lustre.sock", Group: "docker"}, true},
+		{"spec", Config{PluginSpec: "spec"}, true},
+		{"json spec", Config{PluginSpec: "json"}, true},
+		{"unknown spec", Config{PluginSpec: "yaml"}, false},
+		{"shutdown timeout", Config{ShutdownTimeout: "10s"}, true},
+		{"invalid shutdown timeout", Config{ShutdownTimeout: "soon"}, false},
+	} {
+		if err := c.config.validate(); (err == nil) != c.valid {
+			t.Errorf("%s: expected valid %t, got %v", c.name, c.valid, err)
+		}
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	config := &Config{Socket: "/run/lustre.sock", Group: "docker", PluginSpec: "json", ShutdownTimeout: "10s", Managed: true}
+
+	parseFlags(t)
+	applyConfig(config)
+	if !managed {
+		t.Fatal("Expected managed from the configuration file")
+	}
+	if socketAddress != "/run/lustre.sock" || socketGroup != "docker" || specFormat != "json" {
+		t.Fatalf("Expected the configuration file settings, got %s %s %s", socketAddress, socketGroup, specFormat)
+	}
+	if shutdownTimeout != 10*time.Second {
+		t.Fatalf("Expected shutdown timeout 10s, got %s", shutdownTimeout)
+	}
+
+	// Flags on the command line win
+	parseFlags(t, "--socket", "other.sock", "-G", "root", "--plugin-spec", "spec", "--shutdown-timeout", "1m")
+	applyConfig(config)
+	if socketAddress != "other.sock" || socketGroup != "root" || specFormat != "spec" {
+		t.Fatalf("Expected the flag settings, got %s %s %s", socketAddress, socketGroup, specFormat)
+	}
+	if shutdownTimeout != time.Minute {
+		t.Fatalf("Expected shutdown timeout 1m, got %s", shutdownTimeout)
+	}
+}
+
+// captureStdout runs fn and returns what it printed to stdout.
+func captureStdout(t *testing.T, fn func()) []byte {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	out := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		out <- b
+	}()
+
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	fn()
+	w.Close()
+	return <-out
+}
+
+// newCommandRoot points the commands at a new graph root using the lustre
+// driver, and skips the test where the driver can't run.
+func newCommandRoot(t *testing.T) string {
+	root, err := ioutil.TempDir("/var/tmp", "lustre-commands-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parseFlags(t, "-g", root, "-s", "lustre")
+	driver, err := newDriver(true)
+	if err != nil {
+		os.RemoveAll(root)
+		if err == graphdriver.ErrNotSupported || err == graphdriver.ErrPrerequisites || err == graphdriver.ErrIncompatibleFS {
+			t.Skipf("Driver lustre not supported: %v", err)
+		}
+		t.Fatal(err)
+	}
+	if err := shutdownDriver(driver); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+// listLayers runs ls --json and returns the layers it printed.
+func listLayers(t *testing.T) []graphdriver.LayerInfo {
+	var code int
+	out := captureStdout(t, func() { code = runLs([]string{"--json"}) })
+	if code != 0 {
+		t.Fatalf("ls failed with %d", code)
+	}
+	var layers []graphdriver.LayerInfo
+	if err := json.Unmarshal(out, &layers); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	return layers
+}
+
+func TestCommands(t *testing.T) {
+	root := newCommandRoot(t)
+	defer os.RemoveAll(root)
+
+	diff := filepath.Join(root, "base.tar")
+	f, err := os.Create(diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	if err := tw.WriteHeader(&tar.Header{Name: "file", Mode: 0644, Size: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte("base")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	var code int
+	captureStdout(t, func() { code = runImport([]string{"-i", diff, "base"}) })
+	if code != 0 {
+		t.Fatalf("import failed with %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(root, "lustre", "diff", "base", "file")); err != nil {
+		t.Fatalf("Expected the layer in the lustre dir of the root: %v", err)
+	}
+	if layers := listLayers(t); len(layers) != 1 || layers[0].ID != "base" {
+		t.Fatalf("Expected base to be listed, got %+v", layers)
+	}
+
+	if code := runRm([]string{"base"}); code != 0 {
+		t.Fatalf("rm failed with %d", code)
+	}
+	if layers := listLayers(t); len(layers) != 0 {
+		t.Fatalf("Expected no layers after rm, got %+v", layers)
+	}
+}
+
+func TestFsckJSON(t *testing.T) {
+	root := newCommandRoot(t)
+	defer os.RemoveAll(root)
+
+	orphan := filepath.Join(root, "lustre", "diff", "orphan")
+	if err := os.Mkdir(orphan, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		args     []string
+		code     int
+		repaired bool
+	}{
+		{[]string{"--json"}, 1, false},
+		{[]string{"--json", "--repair"}, 0, true},
+	} {
+		var code int
+		out := captureStdout(t, func() { code = runFsck(c.args) })
+		if code != c.code {
+			t.Fatalf("%v: expected exit code %d, got %d", c.args, c.code, code)
+		}
+		var problems []graphdriver.Problem
+		if err := json.Unmarshal(out, &problems); err != nil {
+			t.Fatalf("%v: %v: %s", c.args, err, out)
+		}
+		expected := []graphdriver.Problem{{Kind: "orphan-dir", ID: "orphan", Path: orphan,
+			Detail: "no layers file for this dir", Repaired: c.repaired}}
+		if !reflect.DeepEqual(problems, expected) {
+			t.Fatalf("%v: expected %+v, got %+v", c.args, expected, problems)
+		}
+	}
+	if _, err := os.Lstat(orphan); !os.IsNotExist(err) {
+		t.Fatalf("Expected the orphan dir to be removed: %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/opts"
+	flag "github.com/docker/docker/pkg/mflag"
+)
+
+const (
+	pluginBinary = "/lustre-graph-driver"
+	// pluginRoot is where docker mounts the driver root in the plugin; it
+	// is propagated back to the host so docker can use the mounted layers.
+	pluginRoot = "/var/lib/docker"
+)
+
+// pluginConfig is the config.json of a managed plugin, see
+// https://docs.docker.com/engine/extend/config/
+type pluginConfig struct {
+	Description     string          `json:"description"`
+	Documentation   string          `json:"documentation"`
+	Entrypoint      []string        `json:"entrypoint"`
+	Interface       pluginInterface `json:"interface"`
+	Network         pluginNetwork   `json:"network"`
+	PropagatedMount string          `json:"propagatedMount"`
+	Mounts          []pluginMount   `json:"mounts,omitempty"`
+	Linux           pluginLinux     `json:"linux"`
+}
+
+type pluginInterface struct {
+	Types  []string `json:"types"`
+	Socket string   `json:"socket"`
+}
+
+type pluginNetwork struct {
+	Type string `json:"type"`
+}
+
+type pluginMount struct {
+	Name        string   `json:"name,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Source      string   `json:"source"`
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Options     []string `json:"options"`
+}
+
+type pluginLinux struct {
+	Capabilities []string `json:"capabilities"`
+}
+
+// newPluginConfig returns the config of the managed plugin. When lustreDir
+// is set, it is mounted into the plugin at the same path with shared
+// propagation and used as the driver root, so the layers are kept on Lustre
+// and their mounts show up on the host where docker expects them.
+func newPluginConfig(lustreDir string, storageOpts []string) *pluginConfig {
+	c := &pluginConfig{
+		Description:     "Lustre graph driver",
+		Documentation:   "https://github.com/bacaldwell/lustre-graph-driver",
+		Entrypoint:      []string{pluginBinary, "--managed", "-s", "lustre"},
+		Interface:       pluginInterface{Types: []string{"docker.graphdriver/1.0"}, Socket: "lustre.sock"},
+		Network:         pluginNetwork{Type: "host"},
+		PropagatedMount: pluginRoot,
+		Linux:           pluginLinux{Capabilities: []string{"CAP_SYS_ADMIN", "CAP_LINUX_IMMUTABLE"}},
+	}
+	if lustreDir != "" {
+		c.Entrypoint = append(c.Entrypoint, "-g", lustreDir)
+		c.Mounts = append(c.Mounts, pluginMount{
+			Name:        "lustre",
+			Description: "Lustre dir holding the layers",
+			Source:      lustreDir,
+			Destination: lustreDir,
+			Type:        "bind",
+			Options:     []string{"rbind", "rshared"},
+		})
+	}
+	for _, opt := range storageOpts {
+		c.Entrypoint = append(c.Entrypoint, "--storage-opt", opt)
+	}
+	return c
+}
+
+// buildPluginRootfs creates the rootfs of the managed plugin in dir: the
+// running binary, which must be linked statically, the dirs the plugin
+// needs and the extra host files to add at the same paths.
+func buildPluginRootfs(dir string, files []string) error {
+	for _, d := range []string{"dev", "proc", "sys", "tmp", "etc", "run/docker/plugins", pluginRoot[1:]} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return err
+		}
+	}
+	// docker bind mounts these over the rootfs, they must exist
+	for _, f := range []string{"etc/resolv.conf", "etc/hosts", "etc/hostname"} {
+		if err := touch(filepath.Join(dir, f)); err != nil {
+			return err
+		}
+	}
+
+	if err := copyFile("/proc/self/exe", filepath.Join(dir, pluginBinary), 0755); err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !filepath.IsAbs(f) {
+			return fmt.Errorf("files added to the rootfs need an absolute path, got %s", f)
+		}
+		fi, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(f)), 0755); err != nil {
+			return err
+		}
+		if err := copyFile(f, filepath.Join(dir, f), fi.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func touch(file string) error {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func runPlugin(args []string) int {
+	cmd := flag.NewFlagSet("plugin", flag.ExitOnError)
+	flLustreDir := cmd.String([]string{"-lustre-dir"}, "", "Lustre dir to mount into the plugin and keep the layers in")
+	var files, storageOpts []string
+	cmd.Var(opts.NewListOptsRef(&files, nil), []string{"-add"}, "Host file to add to the rootfs at the same path")
+	cmd.Var(opts.NewListOptsRef(&storageOpts, nil), []string{"-storage-opt"}, "Storage driver option to run the plugin with")
+	if !parseCommandFlags(cmd, args, 1, 1) {
+		return 1
+	}
+	dir := cmd.Arg(0)
+
+	if *flLustreDir != "" && !filepath.IsAbs(*flLustreDir) {
+		fmt.Fprintf(os.Stderr, "--lustre-dir must be an absolute path, got %s\n", *flLustreDir)
+		return 1
+	}
+	if err := buildPluginRootfs(filepath.Join(dir, "rootfs"), files); err != nil {
+		fmt.Fprintf(os.Stderr, "Building rootfs failed: %v\n", err)
+		return 1
+	}
+
+	b, err := json.MarshalIndent(newPluginConfig(*flLustreDir, storageOpts), "", "    ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), append(b, '\n'), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("Create the plugin with: docker plugin create lustre %s\n", dir)
+	return 0
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNewPluginConfig(t *testing.T) {
+	c := newPluginConfig("", nil)
+	if !reflect.DeepEqual(c.Entrypoint, []string{pluginBinary, "--managed", "-s", "lustre"}) {
+		t.Fatalf("Unexpected entrypoint %v", c.Entrypoint)
+	}
+	if len(c.Mounts) != 0 {
+		t.Fatalf("Expected no mounts without a Lustre dir, got %+v", c.Mounts)
+	}
+	if c.PropagatedMount != pluginRoot {
+		t.Fatalf("Expected propagated mount %s, got %s", pluginRoot, c.PropagatedMount)
+	}
+
+	c = newPluginConfig("/lustre/docker", []string{"lustre.gc_rate=10", "lustre.hsm=true"})
+	expected := []string{pluginBinary, "--managed", "-s", "lustre", "-g", "/lustre/docker",
+		"--storage-opt", "lustre.gc_rate=10", "--storage-opt", "lustre.hsm=true"}
+	if !reflect.DeepEqual(c.Entrypoint, expected) {
+		t.Fatalf("Expected entrypoint %v, got %v", expected, c.Entrypoint)
+	}
+	mount := pluginMount{
+		Name:        "lustre",
+		Description: "Lustre dir holding the layers",
+		Source:      "/lustre/docker",
+		Destination: "/lustre/docker",
+		Type:        "bind",
+		Options:     []string{"rbind", "rshared"},
+	}
+	if !reflect.DeepEqual(c.Mounts, []pluginMount{mount}) {
+		t.Fatalf("Expected the Lustre dir mounted with shared propagation, got %+v", c.Mounts)
+	}
+}
+
+func TestBuildPluginRootfs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plugin-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	extra := filepath.Join(dir, "host", "lnet.conf")
+	if err := os.MkdirAll(filepath.Dir(extra), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(extra, []byte("networks: tcp0"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := buildPluginRootfs(rootfs, []string{extra}); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{pluginBinary, "etc/resolv.conf", "etc/hosts", "etc/hostname", "run/docker/plugins", pluginRoot} {
+		if _, err := os.Stat(filepath.Join(rootfs, f)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fi, err := os.Stat(filepath.Join(rootfs, extra))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("Expected the added file to keep mode 0600, got %v", fi.Mode().Perm())
+	}
+
+	if err := buildPluginRootfs(rootfs, []string{"lnet.conf"}); err == nil {
+		t.Fatal("Expected a relative file to be rejected")
+	}
+}
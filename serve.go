@@ -0,0 +1,169 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/bacaldwell/lustre-graph-driver/api"
+	"github.com/bacaldwell/lustre-graph-driver/driver"
+	flag "github.com/docker/docker/pkg/mflag"
+)
+
+// Exit statuses of serve
+const (
+	exitOK = iota
+	// exitError means the plugin failed to start or to serve
+	exitError
+	// exitUnclean means the plugin was stopped, but requests were cut off
+	// at the shutdown timeout or the driver failed to clean up
+	exitUnclean
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+func runServe(args []string) int {
+	cmd := flag.NewFlagSet("serve", flag.ExitOnError)
+	if !parseCommandFlags(cmd, args, 0, 0) {
+		return exitError
+	}
+
+	var h *api.Handler
+	if managed {
+		// Docker passes the driver root and ID maps with Init
+		h = api.NewManagedHandler(newManagedDriver)
+	} else {
+		driver, err := newDriver(false)
+		if err != nil {
+			logrus.Errorf("Create lustre driver failed: %v", err)
+			return exitError
+		}
+		if err := lockRoot(root); err != nil {
+			logrus.Error(err)
+			shutdownDriver(driver)
+			return exitError
+		}
+		h = api.NewHandler(driver)
+	}
+
+	serve, err := setupHandler(h)
+	if err != nil {
+		logrus.Error(err)
+		cleanupDriver(h)
+		return exitError
+	}
+
+	go reloadOnSighup(h.Driver)
+	if metricsAddress != "" {
+		go func() {
+			logrus.Infof("serving metrics on %s", metricsAddress)
+			if err := h.ServeMetrics(metricsAddress); err != nil {
+				logrus.Errorf("Serving metrics failed: %v", err)
+			}
+		}()
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- serve()
+	}()
+
+	select {
+	case err := <-errs:
+		logrus.Errorf("Serving failed: %v", err)
+		h.Shutdown(0)
+		cleanupDriver(h)
+		return exitError
+	case sig := <-sigs:
+		logrus.Infof("Received %s, shutting down", sig)
+	}
+
+	// A second signal skips waiting for the requests in flight
+	go func() {
+		<-sigs
+		logrus.Warn("Received second signal, not waiting for requests to finish")
+		h.Shutdown(0)
+	}()
+
+	status := exitOK
+	if err := h.Shutdown(shutdownTimeout); err != nil {
+		logrus.Errorf("Requests in flight didn't finish within %s: %v", shutdownTimeout, err)
+		status = exitUnclean
+	}
+	<-errs
+	if err := cleanupDriver(h); err != nil {
+		logrus.Errorf("Cleaning up driver failed: %v", err)
+		status = exitUnclean
+	}
+	return status
+}
+
+// setupHandler configures TLS, authorization and spec files of the handler
+// from the flags and returns the function that serves with it. A socket
+// passed by systemd is preferred over --tcp and --socket.
+func setupHandler(h *api.Handler) (func() error, error) {
+	var serverTLS *api.TLSConfig
+	var specTLS *api.SpecTLSConfig
+	if tlsConfig.Certificate != "" {
+		serverTLS = &tlsConfig
+		specTLS = &api.SpecTLSConfig{
+			CAFile:   tlsConfig.CA,
+			CertFile: tlsClientCert,
+			KeyFile:  tlsClientKey,
+		}
+	}
+	if tlsAuthzFile != "" {
+		if serverTLS == nil || !tlsConfig.Verify {
+			return nil, errTLSAuthz
+		}
+		authorizer, err := api.LoadSubjectAuthorizer(tlsAuthzFile)
+		if err != nil {
+			return nil, err
+		}
+		h.SetAuthorizer(authorizer)
+	}
+	if err := h.SetSpec(specFormat, specTLS); err != nil {
+		return nil, err
+	}
+
+	if api.SocketActivated() {
+		return func() error {
+			name := strings.TrimSuffix(filepath.Base(socketAddress), ".sock")
+			return h.ServeActivated(name, serverTLS)
+		}, nil
+	}
+	if tcpAddress != "" {
+		return func() error {
+			logrus.Infof("listening on tcp://%s\n", tcpAddress)
+			name := strings.TrimSuffix(filepath.Base(socketAddress), ".sock")
+			return h.ServeTCP(name, tcpAddress, serverTLS)
+		}, nil
+	}
+	return func() error {
+		logrus.Infof("listening on %s\n", socketAddress)
+		return h.ServeUnix(socketGroup, socketAddress)
+	}, nil
+}
+
+// cleanupDriver shuts down the driver of h, if it has one yet.
+func cleanupDriver(h *api.Handler) error {
+	if driver := h.Driver(); driver != nil {
+		return shutdownDriver(driver)
+	}
+	return nil
+}
+
+// shutdownDriver stops a driver for good, when the plugin or a command
+// exits. Docker's Cleanup requests leave it running.
+func shutdownDriver(driver graphdriver.Driver) error {
+	if s, ok := driver.(graphdriver.Shutdowner); ok {
+		return s.Shutdown()
+	}
+	return driver.Cleanup()
+}
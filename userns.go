@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/pkg/idtools"
+)
+
+// parseRemappedRoot splits a --userns-remap value of the form user[:group]
+// into a user and group name. The group defaults to the user name.
+func parseRemappedRoot(usergrp string) (string, string, error) {
+	idparts := strings.Split(usergrp, ":")
+	if len(idparts) > 2 {
+		return "", "", fmt.Errorf("Invalid user/group specification in --userns-remap: %q", usergrp)
+	}
+	username := idparts[0]
+	if username == "" {
+		return "", "", fmt.Errorf("No user name given in --userns-remap: %q", usergrp)
+	}
+	groupname := username
+	if len(idparts) == 2 && idparts[1] != "" {
+		groupname = idparts[1]
+	}
+	return username, groupname, nil
+}
+
+// setupRemappedRoot reads the subordinate id ranges of the named user and
+// group from /etc/subuid and /etc/subgid.
+func setupRemappedRoot(usergrp string) ([]idtools.IDMap, []idtools.IDMap, error) {
+	if usergrp == "" {
+		return nil, nil, nil
+	}
+	username, groupname, err := parseRemappedRoot(usergrp)
+	if err != nil {
+		return nil, nil, err
+	}
+	uidMaps, gidMaps, err := idtools.CreateIDMappings(username, groupname)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Can't create ID mappings for %s:%s: %v", username, groupname, err)
+	}
+	return uidMaps, gidMaps, nil
+}